@@ -0,0 +1,101 @@
+package mgoauth
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"time"
+)
+
+// ActivityWriter collects the LastActivity updates of the managers it is
+// attached to and writes them in bulk every interval. A single writer should
+// be shared by all the managers of an application.
+type ActivityWriter struct {
+	coll     *mgo.Collection
+	interval time.Duration
+	mu       sync.Mutex
+	pending  map[bson.ObjectId]time.Time
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// NewActivityWriter starts a writer which flushes the pending updates to the
+// users collection of db every interval. It uses its own copy of the db
+// session, Close must be called to release it.
+func NewActivityWriter(db *mgo.Database, interval time.Duration) *ActivityWriter {
+	w := &ActivityWriter{
+		coll:     db.Session.Copy().DB(db.Name).C("mgoauth_user"),
+		interval: interval,
+		pending:  make(map[bson.ObjectId]time.Time),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go w.loop()
+	return w
+}
+
+func (w *ActivityWriter) loop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Flush()
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// Touch records that the user id was active at t.
+func (w *ActivityWriter) Touch(id bson.ObjectId, t time.Time) {
+	w.mu.Lock()
+	if t.After(w.pending[id]) {
+		w.pending[id] = t
+	}
+	w.mu.Unlock()
+}
+
+// Flush writes the pending updates now. Users active in the same second are
+// updated by a single query. Updates which fail are dropped, the next
+// activity of the user will be recorded anyway.
+func (w *ActivityWriter) Flush() error {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[bson.ObjectId]time.Time)
+	w.mu.Unlock()
+
+	batches := make(map[time.Time][]bson.ObjectId)
+	for id, t := range pending {
+		t = t.Truncate(time.Second)
+		batches[t] = append(batches[t], id)
+	}
+
+	var lastErr error
+	for t, ids := range batches {
+		// never move LastActivity backward
+		_, err := w.coll.UpdateAll(bson.M{
+			"_id":          bson.M{"$in": ids},
+			"LastActivity": bson.M{"$lt": t},
+		}, bson.M{"$set": bson.M{"LastActivity": t}})
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// Close stops the writer, flushes the pending updates and releases its
+// session.
+func (w *ActivityWriter) Close() error {
+	close(w.quit)
+	<-w.done
+
+	err := w.Flush()
+	w.coll.Database.Session.Close()
+	return err
+}
@@ -0,0 +1,143 @@
+package mgoauth
+
+import (
+	"errors"
+	"github.com/kidstuff/auth/authmodel"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+// Actions of the audit entries.
+const (
+	AuditImpersonate = "impersonate"
+)
+
+// PriImpersonate is the privilege a user, or one of its groups, needs to
+// call Impersonate.
+const PriImpersonate = "mgoauth_impersonate"
+
+var (
+	ErrReasonRequired = errors.New("mgoauth: a reason is required")
+	// ErrNotPrivileged is returned when the admin given to Impersonate does
+	// not have PriImpersonate.
+	ErrNotPrivileged = errors.New("mgoauth: missing privilege")
+)
+
+// AuditEntry records a sensitive action made by ActorId on the account of
+// UserId.
+type AuditEntry struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Action    string        `bson:"Action"`
+	ActorId   bson.ObjectId `bson:"ActorId"`
+	UserId    bson.ObjectId `bson:"UserId"`
+	SessionId bson.ObjectId `bson:"SessionId,omitempty"`
+	Reason    string        `bson:"Reason,omitempty"`
+	CreatedOn time.Time     `bson:"CreatedOn"`
+}
+
+func (m *MgoManager) audit(entry *AuditEntry) error {
+	entry.Id = bson.NewObjectId()
+	entry.CreatedOn = time.Now()
+	return m.AuditColl.Insert(entry)
+}
+
+// FindAllAudit returns the audit entries about the user, as the actor or
+// the target, newest first.
+func (m *MgoManager) FindAllAudit(userId string, limit int) ([]*AuditEntry, error) {
+	oid, err := getId(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > m.DefaultLimit || limit <= 0 {
+		limit = m.DefaultLimit
+	}
+
+	entries := make([]*AuditEntry, 0, limit)
+	err = m.AuditColl.Find(bson.M{"$or": []bson.M{
+		{"UserId": oid},
+		{"ActorId": oid},
+	}}).Sort("-_id").Limit(limit).All(&entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Impersonate creates a session of the user targetId on behalf of the admin
+// adminId, who must have PriImpersonate, for at most MaxImpersonationTTL.
+// The session is marked with the admin id, it cannot change the user
+// password through UpdateUserDetailAs and it is recorded in the audit log
+// with reason.
+func (m *MgoManager) Impersonate(adminId, targetId, reason string,
+	ttl time.Duration) (string, error) {
+	aid, err := getId(adminId)
+	if err != nil {
+		return "", err
+	}
+
+	oid, err := getId(targetId)
+	if err != nil {
+		return "", err
+	}
+
+	if reason == "" {
+		return "", ErrReasonRequired
+	}
+
+	n, err := m.UserColl.FindId(oid).Count()
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", authmodel.ErrNotFound
+	}
+
+	ok, err := m.hasPrivilege(aid, PriImpersonate)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrNotPrivileged
+	}
+
+	err = m.checkTokenKey()
+	if err != nil {
+		return "", err
+	}
+
+	if ttl <= 0 || ttl > m.MaxImpersonationTTL {
+		ttl = m.MaxImpersonationTTL
+	}
+
+	state, token := m.newLoginState(oid, ttl, nil)
+	// newLoginState rounds short stays up
+	if exp := state.CreatedOn.Add(ttl); state.AbsoluteExpiredOn.After(exp) {
+		state.AbsoluteExpiredOn = exp
+		if state.ExpiredOn.After(exp) {
+			state.ExpiredOn = exp
+		}
+	}
+	state.ImpersonatorId = aid
+	state.AuthMethod = AuthImpersonation
+	state.AuthLevel = AuthLevelNone
+
+	err = m.audit(&AuditEntry{
+		Action:    AuditImpersonate,
+		ActorId:   aid,
+		UserId:    oid,
+		SessionId: state.SessionId,
+		Reason:    reason,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = m.LoginColl.Insert(state)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
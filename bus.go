@@ -0,0 +1,150 @@
+package mgoauth
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"time"
+)
+
+const (
+	// busCollSize is the size in bytes of the capped invalidation collection.
+	busCollSize = 1 << 20
+	// busRetry is how long the bus waits before tailing again after a
+	// failure.
+	busRetry = 5 * time.Second
+)
+
+// invalidation is an event of the bus, exactly one of Token, UserId and All
+// is set, but in the sentinel event EnsureIndex inserts.
+type invalidation struct {
+	Id     bson.ObjectId `bson:"_id"`
+	Node   bson.ObjectId `bson:"Node"`
+	Token  string        `bson:"Token,omitempty"`
+	UserId bson.ObjectId `bson:"UserId,omitempty"`
+	All    bool          `bson:"All,omitempty"`
+}
+
+// InvalidationBus forwards the invalidations of a SessionCache to the other
+// app servers. Events are written to the capped mgoauth_invalidation
+// collection which every node tails. When tailing fails the bus purges the
+// cache and retries every few seconds, meanwhile the cache only relies on
+// its TTL.
+type InvalidationBus struct {
+	coll    *mgo.Collection
+	cache   *SessionCache
+	node    bson.ObjectId
+	mu      sync.Mutex
+	tailing bool
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// NewInvalidationBus starts a bus which evicts the sessions invalidated by
+// other nodes from cache. The bus uses its own copy of the db session,
+// Close must be called to release it. The capped collection and its
+// sentinel event are created by EnsureIndex.
+func NewInvalidationBus(db *mgo.Database, cache *SessionCache) *InvalidationBus {
+	b := &InvalidationBus{
+		coll:  db.Session.Copy().DB(db.Name).C("mgoauth_invalidation"),
+		cache: cache,
+		node:  bson.NewObjectId(),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	go b.loop()
+	return b
+}
+
+func (b *InvalidationBus) loop() {
+	defer close(b.done)
+
+	for {
+		b.tail()
+		b.setTailing(false)
+
+		select {
+		case <-b.quit:
+			return
+		case <-time.After(busRetry):
+		}
+	}
+}
+
+// tail applies the events of the collection in their $natural order until
+// the cursor dies or the bus is closed. Events may have been missed since
+// the previous cursor died, so the cache is purged first. The cursor starts
+// from the oldest event rather than from the last one seen: the ids of the
+// events published by different nodes are not ordered. Applying an event
+// again is harmless.
+func (b *InvalidationBus) tail() {
+	iter := b.coll.Find(nil).Sort("$natural").Tail(time.Second)
+	defer iter.Close()
+
+	b.cache.Purge()
+	b.setTailing(true)
+	ev := invalidation{}
+	for {
+		for iter.Next(&ev) {
+			if ev.Node != b.node {
+				b.apply(&ev)
+			}
+			ev = invalidation{}
+		}
+
+		if !iter.Timeout() {
+			return
+		}
+
+		select {
+		case <-b.quit:
+			return
+		default:
+		}
+	}
+}
+
+func (b *InvalidationBus) apply(ev *invalidation) {
+	switch {
+	case ev.All:
+		b.cache.Purge()
+	case ev.UserId != "":
+		b.cache.evictUser(ev.UserId)
+	case ev.Token != "":
+		b.cache.evictToken(ev.Token)
+	}
+}
+
+func (b *InvalidationBus) setTailing(t bool) {
+	b.mu.Lock()
+	b.tailing = t
+	b.mu.Unlock()
+}
+
+// Tailing reports whether the bus currently receives the events of the
+// other nodes.
+func (b *InvalidationBus) Tailing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tailing
+}
+
+// publish sends ev to the other nodes. Errors are ignored, the other nodes
+// will see the change when their cache entries expire.
+func (b *InvalidationBus) publish(ev *invalidation) {
+	if b == nil {
+		return
+	}
+
+	ev.Id = bson.NewObjectId()
+	ev.Node = b.node
+	b.coll.Insert(ev)
+}
+
+// Close stops the bus and releases its session.
+func (b *InvalidationBus) Close() {
+	close(b.quit)
+	<-b.done
+	b.coll.Database.Session.Close()
+}
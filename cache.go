@@ -0,0 +1,187 @@
+package mgoauth
+
+import (
+	"container/list"
+	"github.com/kidstuff/auth/authmodel"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"time"
+)
+
+// SessionCache is a bounded LRU cache of the users resolved by GetUser. Its
+// entries live for ttl at most, so a change made by another app server
+// takes up to ttl to be seen. A single cache should be shared by all the
+// managers of an application, it is safe for concurrent use.
+type SessionCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+	users map[bson.ObjectId]map[string]bool
+}
+
+type cacheEntry struct {
+	key   string
+	state LoginState
+	// user is BSON encoded, so every get decodes a copy which does not
+	// share its slices, maps and pointers with the other callers.
+	user      []byte
+	expiredOn time.Time
+}
+
+// NewSessionCache returns a cache holding up to size sessions for ttl.
+func NewSessionCache(size int, ttl time.Duration) *SessionCache {
+	return &SessionCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+		users: make(map[bson.ObjectId]map[string]bool),
+	}
+}
+
+// get returns a deep copy of the user and session cached for the hashed
+// token key if the entry and its session are still valid at now.
+func (c *SessionCache) get(key string, now time.Time) (*authmodel.User,
+	*LoginState, bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, nil, false
+	}
+
+	e := elem.Value.(*cacheEntry)
+	if !e.expiredOn.After(now) || !e.state.ExpiredOn.After(now) ||
+		!e.state.TokenExpiredOn.IsZero() && !e.state.TokenExpiredOn.After(now) {
+		c.remove(elem)
+		return nil, nil, false
+	}
+
+	user := &authmodel.User{}
+	if bson.Unmarshal(e.user, user) != nil {
+		c.remove(elem)
+		return nil, nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	state := e.state
+	state.UsedRefreshTokens = append([]string(nil), e.state.UsedRefreshTokens...)
+	return user, &state, true
+}
+
+// add caches a copy of the session state and user for the hashed token key.
+func (c *SessionCache) add(key string, state *LoginState, user *authmodel.User) {
+	if c == nil {
+		return
+	}
+
+	b, err := bson.Marshal(user)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+
+	entry := &cacheEntry{
+		key:       key,
+		state:     *state,
+		user:      b,
+		expiredOn: time.Now().Add(c.ttl),
+	}
+	entry.state.UsedRefreshTokens = append([]string(nil), state.UsedRefreshTokens...)
+	elem := c.ll.PushFront(entry)
+	c.items[key] = elem
+	if c.users[state.UserId] == nil {
+		c.users[state.UserId] = make(map[string]bool)
+	}
+	c.users[state.UserId][key] = true
+
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *SessionCache) remove(elem *list.Element) {
+	e := c.ll.Remove(elem).(*cacheEntry)
+	delete(c.items, e.key)
+	if keys := c.users[e.state.UserId]; keys != nil {
+		delete(keys, e.key)
+		if len(keys) == 0 {
+			delete(c.users, e.state.UserId)
+		}
+	}
+}
+
+// evictToken removes the session of the hashed token key.
+func (c *SessionCache) evictToken(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+	c.mu.Unlock()
+}
+
+// evictUser removes all the sessions of the user id.
+func (c *SessionCache) evictUser(id bson.ObjectId) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	for key := range c.users[id] {
+		c.remove(c.items[key])
+	}
+	c.mu.Unlock()
+}
+
+// Purge removes all the cached sessions.
+func (c *SessionCache) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.users = make(map[bson.ObjectId]map[string]bool)
+	c.mu.Unlock()
+}
+
+// invalidateToken drops the cached session of the hashed token key.
+func (m *MgoManager) invalidateToken(key string) {
+	m.forgetRequestUser()
+	m.Cache.evictToken(key)
+	m.Bus.publish(&invalidation{Token: key})
+}
+
+// invalidateUser drops the cached sessions of the user id, it must be
+// called whenever the user or its sessions change.
+func (m *MgoManager) invalidateUser(id bson.ObjectId) {
+	m.forgetRequestUser()
+	m.Cache.evictUser(id)
+	m.Bus.publish(&invalidation{UserId: id})
+}
+
+// invalidateAll drops every cached session, used when a change may affect
+// many users such as a group update.
+func (m *MgoManager) invalidateAll() {
+	m.forgetRequestUser()
+	m.Cache.Purge()
+	m.Bus.publish(&invalidation{All: true})
+}
@@ -4,8 +4,90 @@ import (
 	"github.com/kidstuff/conf"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// Config keys read by MgoManager.
+const (
+	// ConfigMaxSessions is the maximum number of live sessions of a user,
+	// unset or zero means no limit.
+	ConfigMaxSessions = "mgoauth_max_sessions"
+	// ConfigSessionLimitMode is SessionLimitEvict (the default) or
+	// SessionLimitRefuse.
+	ConfigSessionLimitMode = "mgoauth_session_limit_mode"
+	// ConfigFingerprintMode binds the sessions to the client which created
+	// them, FingerprintFlag or FingerprintStrict. Unset disables it.
+	ConfigFingerprintMode = "mgoauth_fingerprint_mode"
+	// ConfigFingerprintParts is FingerprintIP, FingerprintUserAgent or
+	// both separated by a comma (the default).
+	ConfigFingerprintParts = "mgoauth_fingerprint_parts"
+	// ConfigPwdChangeRevoke set to true ends the sessions of a user when its
+	// password changes, except the one given to UpdateUserDetailAs.
+	ConfigPwdChangeRevoke = "mgoauth_pwd_change_revoke"
+	// ConfigRotateRequired set to true refuses the tokens of the sessions
+	// marked with LoginState.RotateRequired until they are rotated.
+	ConfigRotateRequired = "mgoauth_rotate_required"
+	// ConfigTokensValidAfter is a RFC 3339 time, the sessions and JWTs of
+	// every user created before it are rejected. See RevokeAllUsersSessions.
+	ConfigTokensValidAfter = "mgoauth_tokens_valid_after"
+	// ConfigBcryptCost is the bcrypt cost of the new password hashes, see
+	// SuggestBcryptCost. The passwords hashed with a lower cost are hashed
+	// again at login.
+	ConfigBcryptCost = "mgoauth_bcrypt_cost"
+	// ConfigPwdHasher is the tag of the hasher of the new passwords,
+	// HasherBcrypt by default. The passwords hashed otherwise are hashed
+	// again at login.
+	ConfigPwdHasher = "mgoauth_pwd_hasher"
+	// ConfigPwdHasherParams are the parameters of ConfigPwdHasher, such as
+	// "m=65536,t=3,p=4" for HasherArgon2id.
+	ConfigPwdHasherParams = "mgoauth_pwd_hasher_params"
+	// ConfigPwdHistory is the number of last passwords of a user, the
+	// current one included, a new password must differ from. 0 or unset
+	// disables the check.
+	ConfigPwdHistory = "mgoauth_pwd_history"
+	// ConfigPwdMaxAge is the age, such as "2160h", after which a password
+	// expires and must be changed. 0 or unset disables the expiry.
+	ConfigPwdMaxAge = "mgoauth_pwd_max_age"
+	// ConfigPwdExpiryWarning is how long before the expiry of a password
+	// FindPwdExpiry starts warning about it.
+	ConfigPwdExpiryWarning = "mgoauth_pwd_expiry_warning"
+	// ConfigJWTKeys is the JSON encoded JWT key ring, it is managed by
+	// RotateSigningKey and RetireSigningKey.
+	ConfigJWTKeys = "mgoauth_jwt_keys"
+	// ConfigJWTAlg is the algorithm used to sign JWTs, JWTAlgHS256 or
+	// JWTAlgEdDSA, when ConfigJWTKeys is not set.
+	ConfigJWTAlg = "mgoauth_jwt_alg"
+	// ConfigJWTKey is the base64 encoded HS256 secret, at least 32 bytes,
+	// or Ed25519 seed used to sign JWTs when ConfigJWTKeys is not set.
+	ConfigJWTKey = "mgoauth_jwt_key"
+)
+
+// settingKeys are loaded together by MgoManager.setting.
+var settingKeys = []string{
+	ConfigMaxSessions,
+	ConfigSessionLimitMode,
+	ConfigFingerprintMode,
+	ConfigFingerprintParts,
+	ConfigPwdChangeRevoke,
+	ConfigRotateRequired,
+	ConfigTokensValidAfter,
+	ConfigBcryptCost,
+	ConfigPwdHasher,
+	ConfigPwdHasherParams,
+	ConfigPwdHistory,
+	ConfigPwdMaxAge,
+	ConfigPwdExpiryWarning,
+	ConfigJWTKeys,
+	ConfigJWTAlg,
+	ConfigJWTKey,
+}
+
+// settingsTTL is how long the settings loaded from a config collection are
+// kept.
+const settingsTTL = time.Minute
+
 type MgoConfigMngr struct {
 	ConfigColl *mgo.Collection
 }
@@ -19,6 +101,7 @@ func (c *MgoConfigMngr) Set(key string, val string) error {
 }
 
 func (c *MgoConfigMngr) SetMulti(m map[string]string) error {
+	defer c.resetSettings()
 	for key, val := range m {
 		_, err := c.ConfigColl.UpsertId(key, bson.M{
 			"$set": bson.M{"Val": val},
@@ -35,6 +118,7 @@ func (c *MgoConfigMngr) UnSet(key string) error {
 }
 
 func (c *MgoConfigMngr) UnSetMulti(keys []string) error {
+	defer c.resetSettings()
 	_, err := c.ConfigColl.RemoveAll(bson.M{"_id": bson.M{"$in": keys}})
 	return err
 }
@@ -62,3 +146,74 @@ func (c *MgoConfigMngr) GetMulti(keys []string) (map[string]string, error) {
 
 	return m, err
 }
+
+// loadedSettings are the settings of a config collection, shared by its
+// managers as the handlers create one manager per request.
+type loadedSettings struct {
+	vals map[string]string
+	at   time.Time
+}
+
+var (
+	loadedSettingsMu sync.Mutex
+	loadedSettingsOf = make(map[string]*loadedSettings)
+)
+
+// resetSettings makes the next setting call of the managers using the
+// collection reload the settings.
+func (c *MgoConfigMngr) resetSettings() {
+	loadedSettingsMu.Lock()
+	delete(loadedSettingsOf, c.ConfigColl.FullName)
+	loadedSettingsMu.Unlock()
+}
+
+// setting returns the value of the config key for the manager. All the
+// settingKeys are loaded at first use and kept for settingsTTL, or until
+// they are changed through MgoConfigMngr.
+func (m *MgoManager) setting(key string) string {
+	loadedSettingsMu.Lock()
+	defer loadedSettingsMu.Unlock()
+
+	s := loadedSettingsOf[m.Config.ConfigColl.FullName]
+	if s == nil || time.Since(s.at) > settingsTTL {
+		vals, err := m.Config.GetMulti(settingKeys)
+		if err != nil {
+			// keep using the previous settings, if any
+			if s == nil {
+				return ""
+			}
+			return s.vals[key]
+		}
+		s = &loadedSettings{vals: vals, at: time.Now()}
+		loadedSettingsOf[m.Config.ConfigColl.FullName] = s
+	}
+
+	return s.vals[key]
+}
+
+// settingBool returns the config key as a bool, false if it is not set.
+func (m *MgoManager) settingBool(key string) bool {
+	b, _ := strconv.ParseBool(m.setting(key))
+	return b
+}
+
+// settingDuration returns the config key as a time.Duration or def if it is
+// not set.
+func (m *MgoManager) settingDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(m.setting(key))
+	if err != nil {
+		return def
+	}
+
+	return d
+}
+
+// settingInt returns the config key as an int or def if it is not set.
+func (m *MgoManager) settingInt(key string, def int) int {
+	n, err := strconv.Atoi(m.setting(key))
+	if err != nil {
+		return def
+	}
+
+	return n
+}
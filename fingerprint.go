@@ -0,0 +1,123 @@
+package mgoauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"labix.org/v2/mgo/bson"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Fingerprint modes, see ConfigFingerprintMode.
+const (
+	// FingerprintFlag marks the session as suspicious but accepts it.
+	FingerprintFlag = "flag"
+	// FingerprintStrict rejects the session with ErrFingerprintMismatch.
+	FingerprintStrict = "strict"
+)
+
+// Fingerprint parts, see ConfigFingerprintParts.
+const (
+	FingerprintIP        = "ip"
+	FingerprintUserAgent = "ua"
+)
+
+// fingerprintRank orders the modes from the most permissive.
+func fingerprintRank(mode string) int {
+	switch mode {
+	case FingerprintFlag:
+		return 1
+	case FingerprintStrict:
+		return 2
+	}
+	return 0
+}
+
+// fingerprintMode returns the fingerprint mode of a user with the group
+// policies.
+func (m *MgoManager) fingerprintMode(policies []*GroupPolicy) string {
+	mode := m.setting(ConfigFingerprintMode)
+	set := false
+	for _, p := range policies {
+		if p.FingerprintMode != nil {
+			if !set || fingerprintRank(*p.FingerprintMode) < fingerprintRank(mode) {
+				mode = *p.FingerprintMode
+			}
+			set = true
+		}
+	}
+
+	return mode
+}
+
+// ipPrefix returns the network of ip, a /24 for IPv4 and a /48 for IPv6,
+// so clients moving inside their provider network keep the same prefix.
+func ipPrefix(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+
+	return addr.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+func userAgentHash(ua string) string {
+	sum := sha256.Sum256([]byte(ua))
+	return base64.URLEncoding.EncodeToString(sum[:16])
+}
+
+// bindFingerprint stores the fingerprint of the client info in state if the
+// fingerprint mode of the user requires it.
+func (m *MgoManager) bindFingerprint(state *LoginState, info *LoginInfo,
+	policies []*GroupPolicy) {
+	state.FingerprintMode = m.fingerprintMode(policies)
+	if fingerprintRank(state.FingerprintMode) == 0 {
+		state.FingerprintMode = ""
+		return
+	}
+
+	parts := m.setting(ConfigFingerprintParts)
+	if parts == "" {
+		parts = FingerprintIP + "," + FingerprintUserAgent
+	}
+	if strings.Contains(parts, FingerprintIP) {
+		state.IPPrefix = ipPrefix(info.IP)
+	}
+	if strings.Contains(parts, FingerprintUserAgent) {
+		state.UserAgentHash = userAgentHash(info.UserAgent)
+	}
+}
+
+// checkFingerprint compares the client of req with the one state is bound
+// to and applies the fingerprint mode of the session on a mismatch.
+func (m *MgoManager) checkFingerprint(state *LoginState, req *http.Request) error {
+	if state.FingerprintMode == "" {
+		return nil
+	}
+
+	info := NewLoginInfo(req, "")
+	if (state.IPPrefix == "" || state.IPPrefix == ipPrefix(info.IP)) &&
+		(state.UserAgentHash == "" || state.UserAgentHash == userAgentHash(info.UserAgent)) {
+		return nil
+	}
+
+	if state.FingerprintMode == FingerprintStrict {
+		return ErrFingerprintMismatch
+	}
+
+	if !state.Suspicious {
+		state.Suspicious = true
+		err := m.LoginColl.UpdateId(state.Token, bson.M{
+			"$set": bson.M{"Suspicious": true},
+		})
+		m.invalidateToken(state.Token)
+		return err
+	}
+
+	return nil
+}
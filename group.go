@@ -4,11 +4,25 @@ import (
 	"github.com/kidstuff/auth/authmodel"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"time"
 )
 
 type Group struct {
 	Id              bson.ObjectId `bson:"_id"`
 	authmodel.Group `bson:",inline"`
+	Policy          *GroupPolicy `bson:"Policy,omitempty"`
+}
+
+// GroupPolicy overrides the global settings for the members of a group. Nil
+// fields keep the global setting. When a user belongs to several groups
+// which set the same field the most permissive value is used.
+type GroupPolicy struct {
+	MaxSessions      *int    `bson:"MaxSessions,omitempty"`
+	SessionLimitMode *string `bson:"SessionLimitMode,omitempty"`
+	FingerprintMode  *string `bson:"FingerprintMode,omitempty"`
+	// PwdMaxAge overrides ConfigPwdMaxAge, 0 for passwords which do not
+	// expire.
+	PwdMaxAge *time.Duration `bson:"PwdMaxAge,omitempty"`
 }
 
 func (m *MgoManager) AddGroupDetail(name string, pri []string, info *authmodel.GroupInfo) (*authmodel.Group, error) {
@@ -48,7 +62,133 @@ func (m *MgoManager) UpdateGroupDetail(id string, pri []string, info *authmodel.
 		change["Privileges"] = pri
 	}
 
-	return m.GroupColl.UpdateId(oid, bson.M{"$set": change})
+	err = m.GroupColl.UpdateId(oid, bson.M{"$set": change})
+	m.invalidateAll()
+	return err
+}
+
+// UpdateGroupPolicy replaces the policy of the group, a nil policy removes
+// it.
+func (m *MgoManager) UpdateGroupPolicy(id string, policy *GroupPolicy) error {
+	oid, err := getId(id)
+	if err != nil {
+		return err
+	}
+
+	change := bson.M{"$set": bson.M{"Policy": policy}}
+	if policy == nil {
+		change = bson.M{"$unset": bson.M{"Policy": ""}}
+	}
+
+	err = m.GroupColl.UpdateId(oid, change)
+	m.invalidateAll()
+	return err
+}
+
+func (m *MgoManager) FindGroupPolicy(id string) (*GroupPolicy, error) {
+	oid, err := getId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	group := &Group{}
+	err = m.GroupColl.FindId(oid).Select(bson.M{"Policy": 1}).One(group)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, authmodel.ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	if group.Policy == nil {
+		return &GroupPolicy{}, nil
+	}
+
+	return group.Policy, nil
+}
+
+// hasPrivilege reports whether the user has the privilege pri, itself or
+// through one of its groups.
+func (m *MgoManager) hasPrivilege(oid bson.ObjectId, pri string) (bool, error) {
+	user := &authmodel.User{}
+	err := m.UserColl.FindId(oid).Select(bson.M{"Privileges": 1, "Groups.Id": 1}).One(user)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return false, authmodel.ErrNotFound
+		}
+
+		return false, err
+	}
+
+	aid := make([]bson.ObjectId, 0, len(user.Groups))
+	for _, p := range user.Privileges {
+		if p == pri {
+			return true, nil
+		}
+	}
+	for _, g := range user.Groups {
+		if g.Id != nil && bson.IsObjectIdHex(*g.Id) {
+			aid = append(aid, bson.ObjectIdHex(*g.Id))
+		}
+	}
+
+	if len(aid) == 0 {
+		return false, nil
+	}
+
+	n, err := m.GroupColl.Find(bson.M{
+		"_id":        bson.M{"$in": aid},
+		"Privileges": pri,
+	}).Count()
+	return n > 0, err
+}
+
+// userPolicies returns the policies of the groups the user belongs to.
+func (m *MgoManager) userPolicies(oid bson.ObjectId) ([]*GroupPolicy, error) {
+	user := &authmodel.User{}
+	err := m.UserColl.FindId(oid).Select(bson.M{"Groups.Id": 1}).One(user)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, authmodel.ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return m.groupPolicies(user.Groups)
+}
+
+// groupPolicies returns the policies of groups.
+func (m *MgoManager) groupPolicies(groups []*authmodel.Group) ([]*GroupPolicy, error) {
+	aid := make([]bson.ObjectId, 0, len(groups))
+	for _, g := range groups {
+		if g.Id != nil && bson.IsObjectIdHex(*g.Id) {
+			aid = append(aid, bson.ObjectIdHex(*g.Id))
+		}
+	}
+
+	if len(aid) == 0 {
+		return nil, nil
+	}
+
+	found := []*Group{}
+	err := m.GroupColl.Find(bson.M{
+		"_id":    bson.M{"$in": aid},
+		"Policy": bson.M{"$exists": true},
+	}).Select(bson.M{"Policy": 1}).All(&found)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]*GroupPolicy, 0, len(found))
+	for _, g := range found {
+		if g.Policy != nil {
+			policies = append(policies, g.Policy)
+		}
+	}
+
+	return policies, nil
 }
 
 func (m *MgoManager) FindGroup(id string) (*authmodel.Group, error) {
@@ -168,6 +308,7 @@ func (m *MgoManager) DeleteGroup(id string) error {
 
 	_, err = m.UserColl.UpdateAll(bson.M{"Groups.Id": id},
 		bson.M{"$pull": bson.M{"Groups": bson.M{"Id": id}}})
+	m.invalidateAll()
 	if err != nil {
 		return err
 	}
@@ -1,17 +1,29 @@
 package mgoauth
 
 import (
+	"fmt"
 	"github.com/kidstuff/auth"
+	"github.com/kidstuff/auth/authmodel"
 	"labix.org/v2/mgo"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // Initial function should be called in the application first start
 func Initial(db *mgo.Database) {
+	InitialWith(db, nil)
+}
+
+// InitialWith works like Initial but setup is called with every manager the
+// handlers create, so it can set the manager options and attach the shared
+// components such as an ActivityWriter.
+func InitialWith(db *mgo.Database, setup func(*MgoManager)) {
 	auth.HANDLER_REGISTER = func(fn auth.HandleFunc, owner bool, pri []string) http.Handler {
 		return mongoMngrHandler{
-			db: db,
-			fn: fn,
+			db:    db,
+			fn:    fn,
+			setup: setup,
 			cond: auth.Condition{
 				RequiredPri: pri,
 				Owner:       owner,
@@ -21,17 +33,130 @@ func Initial(db *mgo.Database) {
 }
 
 type mongoMngrHandler struct {
-	db   *mgo.Database
-	fn   auth.HandleFunc
-	cond auth.Condition
+	db    *mgo.Database
+	fn    auth.HandleFunc
+	setup func(*MgoManager)
+	cond  auth.Condition
 }
 
 func (h mongoMngrHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	cloneDB := h.db.Session.Clone().DB(h.db.Name)
 	defer cloneDB.Session.Close()
 
+	mngr := NewMgoManager(cloneDB)
+	mngr.request = req
+	if h.setup != nil {
+		h.setup(mngr)
+	}
+
 	ctx := auth.AuthContext{}
-	ctx.Auth = NewMgoManager(cloneDB)
+	ctx.Auth = mngr
 	ctx.Settings = NewMgoConfigMngr(cloneDB)
 	auth.BasicMngrHandler(&ctx, rw, req, &h.cond, h.fn)
 }
+
+// requestToken returns the access token of req, from the Authorization
+// Bearer header or else the access_token form value.
+func requestToken(req *http.Request) string {
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(h[len("Bearer "):])
+	}
+
+	return req.FormValue("access_token")
+}
+
+// requestSession is the user and session of the token of a request.
+type requestSession struct {
+	user  *authmodel.User
+	state *LoginState
+	err   error
+}
+
+// requestUser returns the user and session of the token of req, none
+// without error if it has no token. The managers created by the handlers
+// serve a single request, they resolve it once and keep the result until
+// invalidateUser or the like.
+func (m *MgoManager) requestUser(req *http.Request) (*authmodel.User,
+	*LoginState, error) {
+	if req == nil {
+		return nil, nil, nil
+	}
+
+	if req != m.request || m.session == nil {
+		s := &requestSession{}
+		if token := requestToken(req); token != "" {
+			s.user, s.state, s.err = m.GetUserRequest(token, req)
+		}
+		if req != m.request {
+			// m may be shared by concurrent requests
+			return s.user, s.state, s.err
+		}
+		m.session = s
+	}
+
+	return m.session.user, m.session.state, m.session.err
+}
+
+// forgetRequestUser drops the result of requestUser once the user or its
+// sessions changed.
+func (m *MgoManager) forgetRequestUser() {
+	if m.request != nil {
+		m.session = nil
+	}
+}
+
+// RequireRecentAuth wraps fn so it only runs if the session of the request
+// token authenticated with at least level within maxAge, for sensitive
+// actions such as an email change. Otherwise it responds 401 with a
+// WWW-Authenticate header asking for a step-up and returns
+// ErrStepUpRequired. fn must be registered through auth.HANDLER_REGISTER
+// after Initial.
+func RequireRecentAuth(fn auth.HandleFunc, maxAge time.Duration, level int) auth.HandleFunc {
+	return func(ctx *auth.AuthContext, rw http.ResponseWriter, req *http.Request) (int, error) {
+		var state *LoginState
+		if m, ok := ctx.Auth.(*MgoManager); ok {
+			_, state, _ = m.requestUser(req)
+		}
+
+		if state == nil || !state.RecentAuth(maxAge, level, time.Now()) {
+			rw.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer error="insufficient_user_authentication", max_age=%d, acr_values="%d"`,
+				int(maxAge/time.Second), level))
+			return http.StatusUnauthorized, ErrStepUpRequired
+		}
+
+		return fn(ctx, rw, req)
+	}
+}
+
+// RequireFreshPwd wraps fn so it does not run for the sessions and JWTs
+// whose password expired, it responds 403 and returns ErrPasswordExpired
+// instead so the app can send the user to its password change form. A token
+// which cannot be checked is refused with 401. fn must be registered
+// through auth.HANDLER_REGISTER after Initial.
+func RequireFreshPwd(fn auth.HandleFunc) auth.HandleFunc {
+	return func(ctx *auth.AuthContext, rw http.ResponseWriter, req *http.Request) (int, error) {
+		if m, ok := ctx.Auth.(*MgoManager); ok {
+			user, state, err := m.requestUser(req)
+			if err != nil {
+				return http.StatusUnauthorized, err
+			}
+
+			expired := state != nil && state.PwdExpired
+			if state == nil && user != nil {
+				// JWTs have no session
+				expiry, err := m.FindPwdExpiry(*user.Id)
+				if err != nil {
+					return http.StatusInternalServerError, err
+				}
+				expired = expiry.Expired
+			}
+
+			if expired {
+				return http.StatusForbidden, ErrPasswordExpired
+			}
+		}
+
+		return fn(ctx, rw, req)
+	}
+}
@@ -0,0 +1,307 @@
+package mgoauth
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Tags of the built-in password hashers, see ConfigPwdHasher.
+const (
+	HasherBcrypt   = "bcrypt"
+	HasherArgon2id = "argon2id"
+	HasherScrypt   = "scrypt"
+	HasherPBKDF2   = "pbkdf2-sha256"
+)
+
+var (
+	ErrUnknownHasher       = errors.New("mgoauth: unknown password hasher")
+	ErrInvalidHasherParams = errors.New("mgoauth: invalid password hasher parameters")
+)
+
+// Hasher hashes the passwords with one algorithm. The hashes it returns
+// start with "$<tag>$" and carry their parameters, so they can be checked
+// whatever the current parameters are.
+type Hasher interface {
+	// Hash returns the hash of pwd with salt.
+	Hash(pwd string, salt []byte) ([]byte, error)
+	// Compare returns nil if hashed is the hash of pwd with salt, or
+	// bcrypt.ErrMismatchedHashAndPassword.
+	Compare(hashed []byte, pwd string, salt []byte) error
+	// NeedsRehash reports whether hashed was not made by the hasher with
+	// its parameters.
+	NeedsRehash(hashed []byte) bool
+}
+
+// HasherFunc returns a Hasher using params, a comma separated list of
+// name=value pairs such as "m=65536,t=3,p=4". The missing ones take their
+// default value.
+type HasherFunc func(params string) (Hasher, error)
+
+const (
+	// maxScryptMemory bounds, in bytes, the memory the scrypt parameters
+	// may ask for, the larger ones are refused rather than crashing the app.
+	maxScryptMemory = 1 << 30
+	// maxArgon2Memory bounds the argon2id memory, in KiB.
+	maxArgon2Memory = 4 << 20
+)
+
+var hashers = map[string]HasherFunc{
+	HasherBcrypt: newBcryptHasher,
+	HasherArgon2id: kdfHasherFunc(HasherArgon2id, "m=65536,t=3,p=4",
+		func(p map[string]int) bool {
+			return p["p"] >= 1 && p["p"] <= 255 && p["m"] >= 8*p["p"] &&
+				p["m"] <= maxArgon2Memory && p["t"] >= 1 && int64(p["t"]) <= math.MaxUint32
+		},
+		func(pwd, salt []byte, p map[string]int) ([]byte, error) {
+			return argon2.IDKey(pwd, salt, uint32(p["t"]), uint32(p["m"]), uint8(p["p"]), 32), nil
+		}),
+	HasherScrypt: kdfHasherFunc(HasherScrypt, "ln=15,r=8,p=1",
+		func(p map[string]int) bool {
+			if p["ln"] < 1 || p["ln"] > 30 || p["r"] < 1 || p["p"] < 1 ||
+				p["r"] > maxScryptMemory/128 || p["p"] > maxScryptMemory/128 {
+				return false
+			}
+			// V takes 128*r*N bytes and B 128*r*p bytes
+			r := int64(p["r"])
+			return 128*r<<uint(p["ln"]) <= maxScryptMemory &&
+				128*r*int64(p["p"]) <= maxScryptMemory
+		},
+		func(pwd, salt []byte, p map[string]int) ([]byte, error) {
+			return scrypt.Key(pwd, salt, 1<<uint(p["ln"]), p["r"], p["p"], 32)
+		}),
+	HasherPBKDF2: kdfHasherFunc(HasherPBKDF2, "i=600000",
+		func(p map[string]int) bool {
+			return p["i"] >= 1
+		},
+		func(pwd, salt []byte, p map[string]int) ([]byte, error) {
+			return pbkdf2.Key(pwd, salt, p["i"], 32, sha256.New), nil
+		}),
+}
+
+// RegisterHasher makes the hasher tag available to ConfigPwdHasher and to
+// check the passwords hashed with it. It is not safe to call it while the
+// managers are used, it is meant for init functions.
+func RegisterHasher(tag string, fn HasherFunc) {
+	hashers[tag] = fn
+}
+
+// NewHasher returns the hasher tag with params.
+func NewHasher(tag, params string) (Hasher, error) {
+	fn, ok := hashers[tag]
+	if !ok {
+		return nil, ErrUnknownHasher
+	}
+
+	return fn(params)
+}
+
+// hasherTag returns the tag of the hasher which made hashed.
+func hasherTag(hashed []byte) string {
+	s := string(hashed)
+	if strings.HasPrefix(s, "$2") {
+		// the first version of the bcrypt hashes had no tag
+		return HasherBcrypt
+	}
+	if strings.HasPrefix(s, "$1$") {
+		return HasherMD5Crypt
+	}
+
+	parts := strings.SplitN(s, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// parseHasherParams parses params into p, which holds the names allowed.
+func parseHasherParams(params string, p map[string]int) error {
+	if params == "" {
+		return nil
+	}
+
+	for _, kv := range strings.Split(params, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return ErrInvalidHasherParams
+		}
+
+		if _, ok := p[kv[:i]]; !ok {
+			return ErrInvalidHasherParams
+		}
+
+		n, err := strconv.Atoi(kv[i+1:])
+		if err != nil {
+			return ErrInvalidHasherParams
+		}
+		p[kv[:i]] = n
+	}
+
+	return nil
+}
+
+// bcryptV2 prefixes the bcrypt hashes of the HMAC-SHA256 of the password
+// keyed by its salt. The first version, a bare bcrypt hash of the password
+// followed by the salt, lost everything past the 72 bytes bcrypt reads.
+const bcryptV2 = "$" + HasherBcrypt + "$v=2$"
+
+type bcryptHasher struct {
+	cost int
+}
+
+// preHash returns the bcrypt input of the version 2 hashes, short enough
+// for any password and free of NUL bytes.
+func (h *bcryptHasher) preHash(pwd string, salt []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(pwd))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func newBcryptHasher(params string) (Hasher, error) {
+	p := map[string]int{"cost": bcrypt.DefaultCost}
+	err := parseHasherParams(params, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if p["cost"] < bcrypt.MinCost || p["cost"] > bcrypt.MaxCost {
+		return nil, ErrInvalidHasherParams
+	}
+
+	return &bcryptHasher{p["cost"]}, nil
+}
+
+func (h *bcryptHasher) Hash(pwd string, salt []byte) ([]byte, error) {
+	b, err := bcrypt.GenerateFromPassword(h.preHash(pwd, salt), h.cost)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(bcryptV2), b...), nil
+}
+
+func (h *bcryptHasher) Compare(hashed []byte, pwd string, salt []byte) error {
+	if !bytes.HasPrefix(hashed, []byte(bcryptV2)) {
+		return bcrypt.CompareHashAndPassword(hashed, saltedPwd(pwd, salt))
+	}
+
+	return bcrypt.CompareHashAndPassword(hashed[len(bcryptV2):], h.preHash(pwd, salt))
+}
+
+func (h *bcryptHasher) NeedsRehash(hashed []byte) bool {
+	if !bytes.HasPrefix(hashed, []byte(bcryptV2)) {
+		return true
+	}
+
+	cost, err := bcrypt.Cost(hashed[len(bcryptV2):])
+	return err != nil || cost < h.cost
+}
+
+// kdfHasher stores the key derived from the password as
+// "$<tag>$<params>$<key>", the key being base64 encoded without padding.
+type kdfHasher struct {
+	tag    string
+	names  []string
+	params string
+	values map[string]int
+	valid  func(p map[string]int) bool
+	key    func(pwd, salt []byte, p map[string]int) ([]byte, error)
+}
+
+// kdfHasherFunc returns the HasherFunc of a key derivation function whose
+// parameters default to defaults.
+func kdfHasherFunc(tag, defaults string, valid func(p map[string]int) bool,
+	key func(pwd, salt []byte, p map[string]int) ([]byte, error)) HasherFunc {
+	return func(params string) (Hasher, error) {
+		h := &kdfHasher{tag: tag, valid: valid, key: key}
+		h.values = make(map[string]int)
+		for _, kv := range strings.Split(defaults, ",") {
+			h.names = append(h.names, kv[:strings.Index(kv, "=")])
+			h.values[h.names[len(h.names)-1]] = 0
+		}
+
+		err := parseHasherParams(defaults, h.values)
+		if err != nil {
+			return nil, err
+		}
+
+		err = parseHasherParams(params, h.values)
+		if err != nil {
+			return nil, err
+		}
+
+		if !valid(h.values) {
+			return nil, ErrInvalidHasherParams
+		}
+
+		h.params = h.format(h.values)
+		return h, nil
+	}
+}
+
+// format returns p in the order of the defaults, so equal parameters give
+// equal strings.
+func (h *kdfHasher) format(p map[string]int) string {
+	parts := make([]string, 0, len(h.names))
+	for _, name := range h.names {
+		parts = append(parts, name+"="+strconv.Itoa(p[name]))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (h *kdfHasher) Hash(pwd string, salt []byte) ([]byte, error) {
+	key, err := h.key([]byte(pwd), salt, h.values)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte("$" + h.tag + "$" + h.params + "$" +
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *kdfHasher) Compare(hashed []byte, pwd string, salt []byte) error {
+	parts := strings.Split(string(hashed), "$")
+	if len(parts) != 4 || parts[1] != h.tag {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+
+	p := make(map[string]int)
+	for _, name := range h.names {
+		p[name] = 0
+	}
+	if parseHasherParams(parts[2], p) != nil || !h.valid(p) {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+
+	key, err := h.key([]byte(pwd), salt, p)
+	if err != nil {
+		return err
+	}
+
+	if len(want) == 0 || subtle.ConstantTimeCompare(key, want) != 1 {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+
+	return nil
+}
+
+func (h *kdfHasher) NeedsRehash(hashed []byte) bool {
+	return !strings.HasPrefix(string(hashed), "$"+h.tag+"$"+h.params+"$")
+}
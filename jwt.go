@@ -0,0 +1,324 @@
+package mgoauth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/kidstuff/auth/authmodel"
+	"labix.org/v2/mgo/bson"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signing algorithms of the JWTs, see ConfigJWTAlg.
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrNoSigningKey     = errors.New("mgoauth: no valid JWT signing key")
+	ErrActiveSigningKey = errors.New("mgoauth: the active signing key cannot be retired")
+)
+
+// JWTClaims are the claims of the JWTs issued by IssueJWT.
+type JWTClaims struct {
+	Id         string   `json:"jti"`
+	Subject    string   `json:"sub"`
+	Privileges []string `json:"pri,omitempty"`
+	Groups     []string `json:"grp,omitempty"`
+	IssuedAt   int64    `json:"iat"`
+	ExpiresAt  int64    `json:"exp"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// revocation revokes the JWT whose id is in _id as "jti:<id>", or the JWTs
+// of a user issued before Before with an _id "user:<id>". It is removed by
+// the TTL index once the tokens it revokes have expired.
+type revocation struct {
+	Id        string    `bson:"_id"`
+	Before    time.Time `bson:"Before,omitempty"`
+	ExpiredOn time.Time `bson:"ExpiredOn"`
+}
+
+// revocationList holds the live revocations of a collection, shared by its
+// managers so the JWTs are checked without a round trip. It is reloaded
+// every settingsTTL, the revocations made by the other app servers apply
+// within that delay.
+type revocationList struct {
+	byId map[string]revocation
+	at   time.Time
+}
+
+var (
+	revocationsMu sync.Mutex
+	revocationsOf = make(map[string]*revocationList)
+)
+
+// revoked returns the revocations among ids, from the revocation list
+// loaded for RevokedColl.
+func (m *MgoManager) revoked(ids ...string) ([]revocation, error) {
+	revocationsMu.Lock()
+	defer revocationsMu.Unlock()
+
+	now := time.Now()
+	l := revocationsOf[m.RevokedColl.FullName]
+	if l == nil || now.Sub(l.at) > settingsTTL {
+		all := []revocation{}
+		err := m.RevokedColl.Find(bson.M{"ExpiredOn": bson.M{"$gt": now}}).All(&all)
+		switch {
+		case err == nil:
+			l = &revocationList{byId: make(map[string]revocation, len(all)), at: now}
+			for _, r := range all {
+				l.byId[r.Id] = r
+			}
+			revocationsOf[m.RevokedColl.FullName] = l
+		case l == nil:
+			return nil, err
+		}
+		// on error, the previous list is used
+	}
+
+	found := make([]revocation, 0, len(ids))
+	for _, id := range ids {
+		if r, ok := l.byId[id]; ok && r.ExpiredOn.After(now) {
+			found = append(found, r)
+		}
+	}
+
+	return found, nil
+}
+
+// addRevocation stores r and adds it to the loaded revocation list.
+func (m *MgoManager) addRevocation(r revocation) error {
+	set := bson.M{"ExpiredOn": r.ExpiredOn}
+	if !r.Before.IsZero() {
+		set["Before"] = r.Before
+	}
+	_, err := m.RevokedColl.UpsertId(r.Id, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+
+	revocationsMu.Lock()
+	if l := revocationsOf[m.RevokedColl.FullName]; l != nil {
+		l.byId[r.Id] = r
+	}
+	revocationsMu.Unlock()
+	return nil
+}
+
+// isJWT reports whether token looks like a JWT rather than a login token.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func encodeJWTPart(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return authmodel.ErrInvalidToken
+	}
+
+	if json.Unmarshal(b, v) != nil {
+		return authmodel.ErrInvalidToken
+	}
+
+	return nil
+}
+
+// IssueJWT returns a signed token carrying the id, privileges and group ids
+// of the user. It is accepted by GetUser without a session lookup until it
+// expires after ttl, at most JWTMaxAge. It returns ErrPasswordExpired if
+// the password of the user must be changed.
+func (m *MgoManager) IssueJWT(id string, ttl time.Duration) (string, error) {
+	key, err := m.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	user, err := m.FindUser(id)
+	if err != nil {
+		return "", err
+	}
+
+	expiry, err := m.FindPwdExpiry(id)
+	if err != nil {
+		return "", err
+	}
+
+	if expiry.Expired {
+		return "", ErrPasswordExpired
+	}
+
+	if ttl <= 0 || ttl > m.JWTMaxAge {
+		ttl = m.JWTMaxAge
+	}
+
+	now := time.Now()
+	claims := JWTClaims{
+		Id:         bson.NewObjectId().Hex(),
+		Subject:    *user.Id,
+		Privileges: user.Privileges,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(ttl).Unix(),
+	}
+	for _, g := range user.Groups {
+		if g.Id != nil {
+			claims.Groups = append(claims.Groups, *g.Id)
+		}
+	}
+
+	header, err := encodeJWTPart(jwtHeader{key.Alg, "JWT", key.Id})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := encodeJWTPart(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := header + "." + payload
+	return input + "." + base64.RawURLEncoding.EncodeToString(key.sign(input)), nil
+}
+
+// ParseJWT verifies the signature and expiry of token and returns its
+// claims. It does not check the revocations, see GetUser.
+func (m *MgoManager) ParseJWT(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, authmodel.ErrInvalidToken
+	}
+
+	header := jwtHeader{}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := m.verificationKey(header.Kid)
+	if err != nil {
+		if err == ErrNoSigningKey {
+			return nil, authmodel.ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	// never let the token choose the algorithm
+	if header.Alg != key.Alg {
+		return nil, authmodel.ErrInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify(parts[0]+"."+parts[1], sig) {
+		return nil, authmodel.ErrInvalidToken
+	}
+
+	claims := &JWTClaims{}
+	err = decodeJWTPart(parts[1], claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bson.IsObjectIdHex(claims.Subject) {
+		return nil, authmodel.ErrInvalidToken
+	}
+
+	if claims.ExpiresAt <= time.Now().Unix() {
+		return nil, ErrSessionExpired
+	}
+
+	return claims, nil
+}
+
+// getJWTUser returns the user carried by a JWT which has not been revoked.
+// The user is built from the claims only, and the keys and revocations are
+// read from memory, so it needs no round trip to the database.
+func (m *MgoManager) getJWTUser(token string) (*authmodel.User, error) {
+	claims, err := m.ParseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := m.revoked("jti:"+claims.Id, "user:"+claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range revoked {
+		if r.Before.IsZero() || claims.IssuedAt < r.Before.Unix() {
+			return nil, authmodel.ErrNotLogged
+		}
+	}
+
+	// JWT times have a second precision
+	if t := m.tokensValidAfter(); !t.IsZero() && claims.IssuedAt <= t.Unix() {
+		return nil, ErrSessionRevoked
+	}
+
+	user := &authmodel.User{
+		Id:         &claims.Subject,
+		Privileges: claims.Privileges,
+		Groups:     make([]*authmodel.Group, 0, len(claims.Groups)),
+	}
+	for i := range claims.Groups {
+		user.Groups = append(user.Groups, &authmodel.Group{Id: &claims.Groups[i]})
+	}
+
+	return user, nil
+}
+
+// revokeJWT revokes a single JWT, or all the JWTs of its user issued so far
+// if all is true.
+func (m *MgoManager) revokeJWT(token string, all bool) error {
+	claims, err := m.ParseJWT(token)
+	if err != nil {
+		if err == ErrSessionExpired {
+			return nil
+		}
+		return err
+	}
+
+	if !all {
+		return m.addRevocation(revocation{
+			Id:        "jti:" + claims.Id,
+			ExpiredOn: time.Unix(claims.ExpiresAt, 0),
+		})
+	}
+
+	oid := bson.ObjectIdHex(claims.Subject)
+	err = m.revokeUserJWT(oid)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.LoginColl.RemoveAll(bson.M{"UserId": oid})
+	m.invalidateUser(oid)
+	return err
+}
+
+// revokeUserJWT revokes the JWTs issued to the user until now.
+func (m *MgoManager) revokeUserJWT(oid bson.ObjectId) error {
+	now := time.Now()
+	return m.addRevocation(revocation{
+		Id: "user:" + oid.Hex(),
+		// JWT times have a second precision
+		Before:    now.Add(time.Second),
+		ExpiredOn: now.Add(m.JWTMaxAge),
+	})
+}
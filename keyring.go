@@ -0,0 +1,244 @@
+package mgoauth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/securecookie"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"time"
+)
+
+// States of a SigningKey.
+const (
+	// KeyActive signs the new JWTs, there is a single active key.
+	KeyActive = "active"
+	// KeyVerifyOnly keys still verify the JWTs they signed.
+	KeyVerifyOnly = "verify"
+	// KeyRetired keys are kept for reference but verify nothing.
+	KeyRetired = "retired"
+)
+
+// SigningKey is a key of the JWT key ring, identified in the tokens by the
+// kid header. For JWTAlgEdDSA keys Key is the Ed25519 seed.
+type SigningKey struct {
+	Id        string    `json:"kid"`
+	Alg       string    `json:"alg"`
+	Key       []byte    `json:"key"`
+	State     string    `json:"state"`
+	CreatedOn time.Time `json:"created"`
+}
+
+func (k *SigningKey) valid() bool {
+	switch k.Alg {
+	case JWTAlgHS256:
+		return len(k.Key) >= 32
+	case JWTAlgEdDSA:
+		return len(k.Key) == ed25519.SeedSize
+	}
+	return false
+}
+
+func (k *SigningKey) sign(input string) []byte {
+	if k.Alg == JWTAlgEdDSA {
+		return ed25519.Sign(ed25519.NewKeyFromSeed(k.Key), []byte(input))
+	}
+
+	mac := hmac.New(sha256.New, k.Key)
+	mac.Write([]byte(input))
+	return mac.Sum(nil)
+}
+
+func (k *SigningKey) verify(input string, sig []byte) bool {
+	if k.Alg == JWTAlgEdDSA {
+		return ed25519.Verify(k.publicKey(), []byte(input), sig)
+	}
+
+	return hmac.Equal(k.sign(input), sig)
+}
+
+func (k *SigningKey) publicKey() ed25519.PublicKey {
+	return ed25519.NewKeyFromSeed(k.Key).Public().(ed25519.PublicKey)
+}
+
+// FindAllSigningKey returns the JWT key ring. When no ring is configured
+// the key set by ConfigJWTAlg and ConfigJWTKey is returned as a single
+// active key without id.
+func (m *MgoManager) FindAllSigningKey() ([]*SigningKey, error) {
+	keys := []*SigningKey{}
+	if ring := m.setting(ConfigJWTKeys); ring != "" {
+		err := json.Unmarshal([]byte(ring), &keys)
+		if err != nil {
+			return nil, err
+		}
+		return keys, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(m.setting(ConfigJWTKey))
+	if err == nil && len(key) > 0 {
+		keys = append(keys, &SigningKey{
+			Alg:   m.setting(ConfigJWTAlg),
+			Key:   key,
+			State: KeyActive,
+		})
+	}
+
+	return keys, nil
+}
+
+// signingKey returns the active key of the ring.
+func (m *MgoManager) signingKey() (*SigningKey, error) {
+	keys, err := m.FindAllSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		if k.State == KeyActive && k.valid() {
+			return k, nil
+		}
+	}
+
+	return nil, ErrNoSigningKey
+}
+
+// verificationKey returns the key kid if it may verify tokens.
+func (m *MgoManager) verificationKey(kid string) (*SigningKey, error) {
+	keys, err := m.FindAllSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		if k.Id == kid && (k.State == KeyActive || k.State == KeyVerifyOnly) && k.valid() {
+			return k, nil
+		}
+	}
+
+	return nil, ErrNoSigningKey
+}
+
+func (m *MgoManager) saveSigningKeys(keys []*SigningKey) error {
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	return m.Config.Set(ConfigJWTKeys, string(b))
+}
+
+// RotateSigningKey generates a new active key for alg. The previous active
+// key becomes verify only so the tokens it signed keep working until they
+// expire, it can then be retired with RetireSigningKey.
+func (m *MgoManager) RotateSigningKey(alg string) (*SigningKey, error) {
+	keys, err := m.FindAllSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{
+		Id:        bson.NewObjectId().Hex(),
+		Alg:       alg,
+		State:     KeyActive,
+		CreatedOn: time.Now(),
+	}
+	if alg == JWTAlgEdDSA {
+		key.Key = securecookie.GenerateRandomKey(ed25519.SeedSize)
+	} else {
+		key.Key = securecookie.GenerateRandomKey(32)
+	}
+	if !key.valid() {
+		return nil, ErrNoSigningKey
+	}
+
+	for _, k := range keys {
+		if k.State == KeyActive {
+			k.State = KeyVerifyOnly
+		}
+	}
+
+	err = m.saveSigningKeys(append(keys, key))
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// RetireSigningKey stops the key kid from verifying tokens. The active key
+// cannot be retired, rotate it first. The key configured before the ring
+// existed has an empty id.
+func (m *MgoManager) RetireSigningKey(kid string) error {
+	keys, err := m.FindAllSigningKey()
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if k.Id == kid {
+			if k.State == KeyActive {
+				return ErrActiveSigningKey
+			}
+			k.State = KeyRetired
+			return m.saveSigningKeys(keys)
+		}
+	}
+
+	return ErrNoSigningKey
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKSHandler serves the public keys which verify the JWTs as a JSON Web
+// Key Set, so other services can check the tokens offline. Only the EdDSA
+// keys are published, HS256 secrets are never exposed.
+func JWKSHandler(db *mgo.Database) http.Handler {
+	return jwksHandler{db}
+}
+
+type jwksHandler struct {
+	db *mgo.Database
+}
+
+func (h jwksHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	cloneDB := h.db.Session.Clone().DB(h.db.Name)
+	defer cloneDB.Session.Close()
+
+	keys, err := NewMgoManager(cloneDB).FindAllSigningKey()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{[]jwk{}}
+	for _, k := range keys {
+		if k.Alg == JWTAlgEdDSA && k.valid() &&
+			(k.State == KeyActive || k.State == KeyVerifyOnly) {
+			set.Keys = append(set.Keys, jwk{
+				Kty: "OKP",
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(k.publicKey()),
+				Kid: k.Id,
+				Alg: JWTAlgEdDSA,
+				Use: "sig",
+			})
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(rw).Encode(set)
+}
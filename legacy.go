@@ -0,0 +1,212 @@
+package mgoauth
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/kidstuff/auth/authmodel"
+	"labix.org/v2/mgo/bson"
+	"strings"
+	"time"
+)
+
+// Tags of the legacy password schemes accepted by ImportUser. They only
+// check the passwords, which are then hashed again at login.
+const (
+	// HasherSHA1SaltPwd is the hex encoded sha1(salt . password).
+	HasherSHA1SaltPwd = "sha1-salt-pwd"
+	// HasherSHA1PwdSalt is the hex encoded sha1(password . salt).
+	HasherSHA1PwdSalt = "sha1-pwd-salt"
+	// HasherMD5Crypt is the "$1$<salt>$<hash>" MD5-crypt of crypt(3).
+	HasherMD5Crypt = "md5-crypt"
+)
+
+var ErrLegacyHasher = errors.New("mgoauth: legacy hashers cannot hash new passwords")
+
+func init() {
+	RegisterHasher(HasherSHA1SaltPwd, legacyHasherFunc(HasherSHA1SaltPwd))
+	RegisterHasher(HasherSHA1PwdSalt, legacyHasherFunc(HasherSHA1PwdSalt))
+	RegisterHasher(HasherMD5Crypt, legacyHasherFunc(HasherMD5Crypt))
+}
+
+// legacyHasher checks the imported hashes. The SHA1 hashes are stored as
+// "$<tag>$$<hex hash>" with their salt in Password.Salt, the MD5-crypt ones
+// as they are.
+type legacyHasher struct {
+	tag string
+}
+
+func legacyHasherFunc(tag string) HasherFunc {
+	return func(params string) (Hasher, error) {
+		if params != "" {
+			return nil, ErrInvalidHasherParams
+		}
+
+		return &legacyHasher{tag}, nil
+	}
+}
+
+func (h *legacyHasher) Hash(pwd string, salt []byte) ([]byte, error) {
+	return nil, ErrLegacyHasher
+}
+
+func (h *legacyHasher) Compare(hashed []byte, pwd string, salt []byte) error {
+	var want []byte
+	switch h.tag {
+	case HasherSHA1SaltPwd:
+		sum := sha1.Sum(append(append([]byte{}, salt...), pwd...))
+		want = []byte("$" + h.tag + "$$" + hex.EncodeToString(sum[:]))
+	case HasherSHA1PwdSalt:
+		sum := sha1.Sum(append([]byte(pwd), salt...))
+		want = []byte("$" + h.tag + "$$" + hex.EncodeToString(sum[:]))
+	case HasherMD5Crypt:
+		parts := strings.Split(string(hashed), "$")
+		if len(parts) != 4 {
+			return bcrypt.ErrMismatchedHashAndPassword
+		}
+		want = md5Crypt([]byte(pwd), []byte(parts[2]))
+	}
+
+	if subtle.ConstantTimeCompare(want, hashed) != 1 {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+
+	return nil
+}
+
+func (h *legacyHasher) NeedsRehash(hashed []byte) bool {
+	return true
+}
+
+const md5CryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// md5Crypt returns the MD5-crypt hash of pwd with salt, as crypt(3).
+func md5Crypt(pwd, salt []byte) []byte {
+	magic := []byte("$1$")
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.New()
+	alt.Write(pwd)
+	alt.Write(salt)
+	alt.Write(pwd)
+	mixin := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pwd)
+	d.Write(magic)
+	d.Write(salt)
+	for i := len(pwd); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(mixin)
+		} else {
+			d.Write(mixin[:i])
+		}
+	}
+	for i := len(pwd); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pwd[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pwd)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write(salt)
+		}
+		if i%7 != 0 {
+			d.Write(pwd)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pwd)
+		}
+		final = d.Sum(nil)
+	}
+
+	out := append(append(magic, salt...), '$')
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, md5CryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+
+	return out
+}
+
+// legacyPwd returns the password stored for a hash imported with the
+// scheme tag.
+func legacyPwd(tag, hashed, salt string) (*authmodel.Password, error) {
+	p := &authmodel.Password{InitAt: time.Now()}
+	switch tag {
+	case HasherSHA1SaltPwd, HasherSHA1PwdSalt:
+		if len(hashed) != 2*sha1.Size {
+			return nil, authmodel.ErrInvalidPassword
+		}
+		if _, err := hex.DecodeString(hashed); err != nil {
+			return nil, authmodel.ErrInvalidPassword
+		}
+		p.Hashed = []byte("$" + tag + "$$" + strings.ToLower(hashed))
+		p.Salt = []byte(salt)
+	case HasherMD5Crypt:
+		if !strings.HasPrefix(hashed, "$1$") || strings.Count(hashed, "$") != 3 {
+			return nil, authmodel.ErrInvalidPassword
+		}
+		p.Hashed = []byte(hashed)
+	default:
+		return nil, ErrUnknownHasher
+	}
+
+	return p, nil
+}
+
+// ImportUser adds a user whose password is hashed with the legacy scheme
+// tag, HasherSHA1SaltPwd, HasherSHA1PwdSalt or HasherMD5Crypt. salt is only
+// used by the SHA1 schemes. The password is hashed with the current hasher
+// at the first login of the user.
+func (m *MgoManager) ImportUser(email, tag, hashed, salt string,
+	app bool) (*authmodel.User, error) {
+	return m.ImportUserDetail(email, tag, hashed, salt, app, nil, nil, nil, nil)
+}
+
+// ImportUserDetail is ImportUser with the details of AddUserDetail.
+func (m *MgoManager) ImportUserDetail(email, tag, hashed, salt string,
+	app bool, pri []string, code map[string]string, profile *authmodel.Profile,
+	groupIds []string) (*authmodel.User, error) {
+	if !m.Formater.EmailValidate(email) {
+		return nil, authmodel.ErrInvalidEmail
+	}
+
+	p, err := legacyPwd(tag, hashed, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	u := newUserPwd(email, p, app)
+	u.LegacyPwd = true
+	return m.insertUserDetail(u, pri, code, profile, groupIds)
+}
+
+// CountLegacyPwd returns the number of users whose password is still
+// hashed with a legacy scheme, they have not logged in since their import.
+func (m *MgoManager) CountLegacyPwd() (int, error) {
+	return m.UserColl.Find(bson.M{"LegacyPwd": true}).Count()
+}
@@ -1,9 +1,16 @@
 package mgoauth_test
 
 import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/kidstuff/auth"
 	"github.com/kidstuff/auth-mongo-mngr"
 	"github.com/kidstuff/auth/authmodel"
 	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,6 +39,7 @@ func tearDown(dbname string) {
 }
 
 func TestMain(t *testing.T) {
+	os.Setenv("MGOAUTH_TOKEN_KEY", "mgoauth test token key")
 	dbname := "mgoauth_test_user_mannager"
 	mngr := newManager(dbname)
 	defer tearDown(dbname)
@@ -51,7 +59,32 @@ func TestMain(t *testing.T) {
 	gid = testManagerAddGroupDetail(t, mngr)
 	testManagerFindAllUser(t, mngr, gid)
 
-	testManagerLogin(t, mngr, testManagerAddUser(t, mngr))
+	uid = testManagerAddUser(t, mngr)
+	testManagerLogin(t, mngr, uid)
+	testManagerRefresh(t, mngr.(*mgoauth.MgoManager), uid)
+	testManagerTokenKey(t, dbname, uid)
+	testManagerSession(t, mngr.(*mgoauth.MgoManager), uid)
+	testManagerSessionLimit(t, mngr.(*mgoauth.MgoManager), uid)
+	testManagerExpiry(t, mngr.(*mgoauth.MgoManager), uid)
+	testManagerActivity(t, mngr.(*mgoauth.MgoManager), uid)
+	testManagerOnline(t, mngr.(*mgoauth.MgoManager), uid)
+	testManagerCache(t, mngr.(*mgoauth.MgoManager), uid)
+	testManagerBus(t, dbname, uid)
+	testManagerJWT(t, newManager(dbname).(*mgoauth.MgoManager), uid)
+	testManagerImpersonate(t, newManager(dbname).(*mgoauth.MgoManager), uid)
+	testManagerStepUp(t, newManager(dbname).(*mgoauth.MgoManager), uid)
+	testManagerFingerprint(t, dbname, uid)
+	testManagerRotateToken(t, newManager(dbname).(*mgoauth.MgoManager), uid)
+	testManagerPwdChangeRevoke(t, dbname, uid)
+	testManagerRevokeAll(t, newManager(dbname).(*mgoauth.MgoManager), uid)
+	testManagerDeleteUserDetail(t, newManager(dbname).(*mgoauth.MgoManager), uid)
+	testManagerBcryptCost(t, dbname)
+	testManagerHasher(t, dbname)
+	testManagerImportUser(t, newManager(dbname).(*mgoauth.MgoManager))
+	testManagerLongPassword(t, newManager(dbname).(*mgoauth.MgoManager))
+	testManagerPepper(t, dbname)
+	testManagerPwdHistory(t, dbname)
+	testManagerPwdExpiry(t, dbname)
 }
 
 // testManagerAddUser check if add user work
@@ -341,6 +374,11 @@ func testManagerLogin(t *testing.T, mngr authmodel.Manager, uid string) {
 		t.Fatal("cannot login:", err)
 	}
 
+	n, err := mngr.(*mgoauth.MgoManager).LoginColl.FindId(token).Count()
+	if err != nil || n != 0 {
+		t.Fatal("login token must not be stored in plain text")
+	}
+
 	u, err := mngr.GetUser(token)
 	if err != nil {
 		t.Fatal("cannot get logged user:", err)
@@ -382,6 +420,15 @@ func testManagerLogin(t *testing.T, mngr authmodel.Manager, uid string) {
 		t.Fatal("token must not be the same")
 	}
 
+	if strings.Contains(token, uid) {
+		t.Fatal("token must not contain the user id")
+	}
+
+	_, err = mngr.GetUser("mgo1_malformed")
+	if err != authmodel.ErrInvalidToken {
+		t.Fatal("malformed token must be rejected:", err)
+	}
+
 	err = mngr.Logout(token, false)
 	if err != nil {
 		t.Fatal("cannot logout user:", err)
@@ -407,3 +454,1533 @@ func testManagerLogin(t *testing.T, mngr authmodel.Manager, uid string) {
 		t.Fatal("logout all user's session didn't work")
 	}
 }
+
+// testManagerTokenKey checks that the sessions are refused without a token
+// key instead of being hashed with an empty one.
+func testManagerTokenKey(t *testing.T, dbname, uid string) {
+	mngr := newManager(dbname).(*mgoauth.MgoManager)
+	token := mustLogin(t, mngr, uid)
+
+	mngr.TokenKey = nil
+	_, err := mngr.Login(uid, time.Hour)
+	if err != mgoauth.ErrNoTokenKey {
+		t.Fatal("login without token key must be refused:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != mgoauth.ErrNoTokenKey {
+		t.Fatal("session without token key must be refused:", err)
+	}
+}
+
+// testManagerRefresh checks that a refresh token rotates the token pair and
+// that replaying an exchanged refresh token revokes the session.
+func testManagerRefresh(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	token, refresh, err := mngr.LoginWithRefresh(uid, time.Hour)
+	if err != nil {
+		t.Fatal("cannot login:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	token2, refresh2, err := mngr.Refresh(refresh)
+	if err != nil {
+		t.Fatal("cannot refresh token:", err)
+	}
+
+	if token2 == token || refresh2 == refresh {
+		t.Fatal("refresh must issue new tokens")
+	}
+
+	_, err = mngr.GetUser(token)
+	if err == nil {
+		t.Fatal("refreshed token must stop working")
+	}
+
+	_, err = mngr.GetUser(token2)
+	if err != nil {
+		t.Fatal("cannot get logged user with refreshed token:", err)
+	}
+
+	_, _, err = mngr.Refresh(refresh)
+	if err != mgoauth.ErrRefreshTokenReused {
+		t.Fatal("must detect refresh token reuse:", err)
+	}
+
+	_, err = mngr.GetUser(token2)
+	if err == nil {
+		t.Fatal("refresh token reuse must revoke the session")
+	}
+}
+
+// testManagerSession logs in from two devices then revokes one of them by its
+// session id.
+func testManagerSession(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	err := mngr.Logout(mustLogin(t, mngr, uid), true)
+	if err != nil {
+		t.Fatal("cannot logout user:", err)
+	}
+
+	token, _, err := mngr.LoginDetail(uid, time.Hour, false, &mgoauth.LoginInfo{
+		IP:        "127.0.0.1",
+		UserAgent: "testing",
+		Device:    "laptop",
+	})
+	if err != nil {
+		t.Fatal("cannot login:", err)
+	}
+
+	token2, _, err := mngr.LoginDetail(uid, time.Hour, false, &mgoauth.LoginInfo{
+		Device: "phone",
+	})
+	if err != nil {
+		t.Fatal("cannot login:", err)
+	}
+
+	sessions, err := mngr.FindAllSession(uid)
+	if err != nil {
+		t.Fatal("cannot list sessions:", err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatal("expect 2 sessions, found", len(sessions))
+	}
+
+	laptop, phone := sessions[0], sessions[1]
+	if laptop.Device != "laptop" {
+		laptop, phone = phone, laptop
+	}
+
+	if laptop.Device != "laptop" || laptop.IP != "127.0.0.1" ||
+		laptop.UserAgent != "testing" || laptop.CreatedOn.IsZero() || laptop.Token != "" {
+		t.Fatal("session metadata not recorded")
+	}
+
+	err = mngr.RevokeSession(uid, phone.SessionId.Hex())
+	if err != nil {
+		t.Fatal("cannot revoke session:", err)
+	}
+
+	_, err = mngr.GetUser(token2)
+	if err == nil {
+		t.Fatal("revoked session must stop working")
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("other sessions must keep working:", err)
+	}
+
+	// the managers of the handlers record the client of their request
+	mgoauth.InitialWith(mngr.UserColl.Database, nil)
+	h := auth.HANDLER_REGISTER(func(ctx *auth.AuthContext, rw http.ResponseWriter,
+		req *http.Request) (int, error) {
+		_, err = ctx.Auth.Login(uid, time.Hour)
+		return http.StatusOK, nil
+	}, false, nil)
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "handler")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal("cannot login from a handler:", err)
+	}
+
+	sessions, err = mngr.FindAllSession(uid)
+	if err != nil {
+		t.Fatal("cannot list sessions:", err)
+	}
+
+	recorded := false
+	for _, s := range sessions {
+		recorded = recorded || s.IP == "10.0.0.1" && s.UserAgent == "handler"
+	}
+	if !recorded {
+		t.Fatal("login from a handler must record its client")
+	}
+}
+
+// testManagerJWT issues a JWT then revokes it.
+func testManagerJWT(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	err := mngr.Config.SetMulti(map[string]string{
+		mgoauth.ConfigJWTAlg: mgoauth.JWTAlgHS256,
+		mgoauth.ConfigJWTKey: "c2VjcmV0IGtleSB1c2VkIHRvIHNpZ24gdGhlIHRlc3QgdG9rZW5z",
+	})
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+
+	token, err := mngr.IssueJWT(uid, time.Minute)
+	if err != nil {
+		t.Fatal("cannot issue JWT:", err)
+	}
+
+	u, err := mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("cannot get user from JWT:", err)
+	}
+
+	if *u.Id != uid {
+		t.Fatal("JWT user and user returned not the same")
+	}
+
+	_, err = mngr.GetUser(token[:len(token)-2] + "AA")
+	if err != authmodel.ErrInvalidToken {
+		t.Fatal("JWT signature must be checked:", err)
+	}
+
+	err = mngr.Logout(token, false)
+	if err != nil {
+		t.Fatal("cannot revoke JWT:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err == nil {
+		t.Fatal("revoked JWT must be rejected")
+	}
+
+	testManagerSigningKey(t, mngr, uid)
+}
+
+// testManagerSigningKey rotates the JWT signing key and checks that the
+// tokens signed by the previous key keep working until it is retired.
+func testManagerSigningKey(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	token, err := mngr.IssueJWT(uid, time.Minute)
+	if err != nil {
+		t.Fatal("cannot issue JWT:", err)
+	}
+
+	key, err := mngr.RotateSigningKey(mgoauth.JWTAlgEdDSA)
+	if err != nil {
+		t.Fatal("cannot rotate signing key:", err)
+	}
+
+	token2, err := mngr.IssueJWT(uid, time.Minute)
+	if err != nil {
+		t.Fatal("cannot issue JWT:", err)
+	}
+
+	for _, tok := range []string{token, token2} {
+		_, err = mngr.GetUser(tok)
+		if err != nil {
+			t.Fatal("cannot get user from JWT:", err)
+		}
+	}
+
+	err = mngr.RetireSigningKey(key.Id)
+	if err != mgoauth.ErrActiveSigningKey {
+		t.Fatal("active signing key must not be retired:", err)
+	}
+
+	err = mngr.RetireSigningKey("")
+	if err != nil {
+		t.Fatal("cannot retire signing key:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != authmodel.ErrInvalidToken {
+		t.Fatal("JWT signed by a retired key must be rejected:", err)
+	}
+
+	_, err = mngr.GetUser(token2)
+	if err != nil {
+		t.Fatal("cannot get user from JWT:", err)
+	}
+}
+
+// testManagerImpersonate logs in as the user on behalf of an admin and checks
+// the session can't change the user password.
+func testManagerImpersonate(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	admin, err := mngr.AddUser("admin@example.com", "admin123edc", true)
+	if err != nil {
+		t.Fatal("cannot add user", err)
+	}
+
+	_, err = mngr.Impersonate(*admin.Id, uid, "ticket 42", time.Minute)
+	if err != mgoauth.ErrNotPrivileged {
+		t.Fatal("impersonation must require the privilege:", err)
+	}
+
+	err = mngr.UpdateUserDetail(*admin.Id, nil, nil, []string{mgoauth.PriImpersonate}, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot update user detail:", err)
+	}
+
+	_, err = mngr.Impersonate(*admin.Id, uid, "", time.Minute)
+	if err != mgoauth.ErrReasonRequired {
+		t.Fatal("impersonation must require a reason:", err)
+	}
+
+	token, err := mngr.Impersonate(*admin.Id, uid, "ticket 42", time.Minute)
+	if err != nil {
+		t.Fatal("cannot impersonate user:", err)
+	}
+
+	u, state, err := mngr.GetUserDetail(token)
+	if err != nil {
+		t.Fatal("cannot get impersonated user:", err)
+	}
+
+	if *u.Id != uid || state.ImpersonatorId.Hex() != *admin.Id {
+		t.Fatal("impersonation session must carry both identities")
+	}
+
+	if state.AbsoluteExpiredOn.After(time.Now().Add(time.Minute)) {
+		t.Fatal("impersonation session must not outlive its ttl")
+	}
+
+	ps := "impersonated123"
+	err = mngr.UpdateUserDetailAs(state, uid, &ps, nil, nil, nil, nil, nil)
+	if err != mgoauth.ErrImpersonated {
+		t.Fatal("impersonation must not change the password:", err)
+	}
+
+	// the managers of the handlers act on behalf of the request session
+	mgoauth.InitialWith(mngr.UserColl.Database, nil)
+	err = nil
+	h := auth.HANDLER_REGISTER(func(ctx *auth.AuthContext, rw http.ResponseWriter,
+		req *http.Request) (int, error) {
+		err = ctx.Auth.UpdateUserDetail(uid, &ps, nil, nil, nil, nil, nil)
+		return http.StatusOK, nil
+	}, false, nil)
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if err != mgoauth.ErrImpersonated {
+		t.Fatal("impersonation must not change the password from a handler:", err)
+	}
+
+	// the impersonation session must not block the other changes
+	ps = "admin321edc"
+	err = mngr.UpdateUserDetail(*admin.Id, &ps, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot change password:", err)
+	}
+
+	entries, err := mngr.FindAllAudit(uid, -1)
+	if err != nil {
+		t.Fatal("cannot find audit entries:", err)
+	}
+
+	if len(entries) != 1 || entries[0].Action != mgoauth.AuditImpersonate ||
+		entries[0].Reason != "ticket 42" {
+		t.Fatal("impersonation must be audited")
+	}
+}
+
+// testManagerStepUp checks the assurance level recorded with the sessions
+// and its upgrade by Reauthenticate.
+func testManagerStepUp(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	token := mustLogin(t, mngr, uid)
+	_, state, err := mngr.GetUserDetail(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	now := time.Now()
+	if state.AuthMethod != mgoauth.AuthPassword ||
+		!state.RecentAuth(time.Minute, mgoauth.AuthLevelPassword, now) {
+		t.Fatal("login must record a password authentication")
+	}
+
+	if state.RecentAuth(time.Minute, mgoauth.AuthLevelMFA, now) ||
+		state.RecentAuth(time.Minute, mgoauth.AuthLevelPassword, now.Add(time.Hour)) {
+		t.Fatal("step-up must be required for a higher level or an old authentication")
+	}
+
+	err = mngr.Reauthenticate(token, mgoauth.AuthMFA)
+	if err != nil {
+		t.Fatal("cannot reauthenticate:", err)
+	}
+
+	_, state, err = mngr.GetUserDetail(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	if !state.RecentAuth(time.Minute, mgoauth.AuthLevelMFA, time.Now()) {
+		t.Fatal("reauthentication must raise the session level")
+	}
+
+	// the wrapper finds the session itself, without owner or privileges
+	fn := mgoauth.RequireRecentAuth(func(*auth.AuthContext, http.ResponseWriter,
+		*http.Request) (int, error) {
+		return http.StatusOK, nil
+	}, time.Minute, mgoauth.AuthLevelMFA)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	status, err := fn(&auth.AuthContext{Auth: mngr}, httptest.NewRecorder(), req)
+	if status != http.StatusOK || err != nil {
+		t.Fatal("recent authentication must be accepted:", status, err)
+	}
+
+	req.Header.Del("Authorization")
+	status, err = fn(&auth.AuthContext{Auth: mngr}, httptest.NewRecorder(), req)
+	if status != http.StatusUnauthorized || err != mgoauth.ErrStepUpRequired {
+		t.Fatal("request without session must require a step-up:", status, err)
+	}
+}
+
+// testManagerFingerprint binds a session to its client and uses it from
+// another network.
+func testManagerFingerprint(t *testing.T, dbname, uid string) {
+	mngr := newManager(dbname).(*mgoauth.MgoManager)
+	err := mngr.Config.Set(mgoauth.ConfigFingerprintMode, mgoauth.FingerprintStrict)
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+	defer mngr.Config.UnSet(mgoauth.ConfigFingerprintMode)
+
+	token, _, err := mngr.LoginDetail(uid, time.Hour, false, &mgoauth.LoginInfo{
+		IP:        "10.0.0.1",
+		UserAgent: "testing",
+	})
+	if err != nil {
+		t.Fatal("cannot login:", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.7:1234"
+	req.Header.Set("User-Agent", "testing")
+	_, _, err = mngr.GetUserRequest(token, req)
+	if err != nil {
+		t.Fatal("session must be accepted from the same network:", err)
+	}
+
+	req.RemoteAddr = "192.168.1.1:1234"
+	_, _, err = mngr.GetUserRequest(token, req)
+	if err != mgoauth.ErrFingerprintMismatch {
+		t.Fatal("session must be rejected from another network:", err)
+	}
+
+	// the managers of the handlers bind the sessions to their request
+	mgoauth.InitialWith(mngr.UserColl.Database, nil)
+	h := auth.HANDLER_REGISTER(func(ctx *auth.AuthContext, rw http.ResponseWriter,
+		req *http.Request) (int, error) {
+		token, _, err = ctx.Auth.(*mgoauth.MgoManager).LoginWithRefresh(uid, time.Hour)
+		return http.StatusOK, nil
+	}, false, nil)
+	req.RemoteAddr = "10.0.0.7:1234"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal("cannot login from a handler:", err)
+	}
+
+	req.RemoteAddr = "192.168.1.1:1234"
+	_, _, err = mngr.GetUserRequest(token, req)
+	if err != mgoauth.ErrFingerprintMismatch {
+		t.Fatal("session created by a handler must be bound:", err)
+	}
+}
+
+// testManagerRotateToken changes the user privileges and replaces the token
+// the session was using.
+func testManagerRotateToken(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	err := mngr.Config.Set(mgoauth.ConfigRotateRequired, "true")
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+	defer mngr.Config.UnSet(mgoauth.ConfigRotateRequired)
+
+	token := mustLogin(t, mngr, uid)
+	_, state, err := mngr.GetUserDetail(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	jwt, err := mngr.IssueJWT(uid, time.Minute)
+	if err != nil {
+		t.Fatal("cannot issue JWT:", err)
+	}
+
+	err = mngr.UpdateUserDetail(uid, nil, nil, []string{"rotated"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot update user detail:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != mgoauth.ErrRotateRequired {
+		t.Fatal("privilege change must require a token rotation:", err)
+	}
+
+	_, err = mngr.GetUser(jwt)
+	if err == nil {
+		t.Fatal("privilege change must revoke the JWTs")
+	}
+
+	token2, err := mngr.RotateToken(token)
+	if err != nil {
+		t.Fatal("cannot rotate token:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err == nil {
+		t.Fatal("rotated token must stop working")
+	}
+
+	_, state2, err := mngr.GetUserDetail(token2)
+	if err != nil {
+		t.Fatal("cannot get logged user with rotated token:", err)
+	}
+
+	if state2.RotateRequired || state2.SessionId != state.SessionId ||
+		!state2.CreatedOn.Equal(state.CreatedOn) {
+		t.Fatal("token rotation must keep the session")
+	}
+
+	err = mngr.Config.UnSet(mgoauth.ConfigRotateRequired)
+	if err != nil {
+		t.Fatal("cannot unset config:", err)
+	}
+
+	err = mngr.UpdateUserDetail(uid, nil, nil, []string{}, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot update user detail:", err)
+	}
+
+	_, err = mngr.GetUser(token2)
+	if err != nil {
+		t.Fatal("rotation must only be enforced when configured:", err)
+	}
+}
+
+// testManagerPwdChangeRevoke changes the user password from one of its
+// sessions and checks that only this session is kept.
+func testManagerPwdChangeRevoke(t *testing.T, dbname, uid string) {
+	mngr := newManager(dbname).(*mgoauth.MgoManager)
+	err := mngr.Config.Set(mgoauth.ConfigPwdChangeRevoke, "true")
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+	defer mngr.Config.UnSet(mgoauth.ConfigPwdChangeRevoke)
+
+	other := mustLogin(t, mngr, uid)
+	token := mustLogin(t, mngr, uid)
+	_, actor, err := mngr.GetUserDetail(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	ps := "revoke123edc"
+	err = mngr.UpdateUserDetailAs(actor, uid, &ps, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot change password:", err)
+	}
+
+	_, err = mngr.GetUser(other)
+	if err != authmodel.ErrNotLogged {
+		t.Fatal("password change must end the other sessions:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("password change must keep the actor session:", err)
+	}
+
+	// the managers of the handlers keep the request session
+	mgoauth.InitialWith(mngr.UserColl.Database, nil)
+	other = mustLogin(t, mngr, uid)
+	err = authmodel.ErrNotLogged
+	h := auth.HANDLER_REGISTER(func(ctx *auth.AuthContext, rw http.ResponseWriter,
+		req *http.Request) (int, error) {
+		ps := "revoke321edc"
+		err = ctx.Auth.UpdateUserDetail(uid, &ps, nil, nil, nil, nil, nil)
+		return http.StatusOK, nil
+	}, false, nil)
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal("cannot change password from a handler:", err)
+	}
+
+	_, err = mngr.GetUser(other)
+	if err != authmodel.ErrNotLogged {
+		t.Fatal("password change must end the other sessions:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("password change must keep the request session:", err)
+	}
+}
+
+// testManagerRevokeAll revokes the sessions of the user, then the sessions
+// of every user, and checks that new sessions still work.
+func testManagerRevokeAll(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	token := mustLogin(t, mngr, uid)
+	err := mngr.RevokeAllSessions(uid)
+	if err != nil {
+		t.Fatal("cannot revoke the user sessions:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err == nil {
+		t.Fatal("revoked session must stop working")
+	}
+
+	token = mustLogin(t, mngr, uid)
+	_, err = mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("new session must work after revocation:", err)
+	}
+
+	err = mngr.RevokeAllUsersSessions()
+	if err != nil {
+		t.Fatal("cannot revoke all sessions:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != mgoauth.ErrSessionRevoked {
+		t.Fatal("session created before the epoch must be revoked, got:", err)
+	}
+
+	token = mustLogin(t, mngr, uid)
+	_, err = mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("new session must work after global revocation:", err)
+	}
+}
+
+// testManagerDeleteUserDetail checks that deleting a user removes its
+// sessions and keeps its audit trail.
+func testManagerDeleteUserDetail(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	token := mustLogin(t, mngr, uid)
+	result, err := mngr.DeleteUserDetail(uid)
+	if err != nil {
+		t.Fatal("cannot delete user:", err)
+	}
+
+	if result.Sessions == 0 {
+		t.Fatal("delete user must remove its sessions")
+	}
+
+	n, err := mngr.LoginColl.Find(bson.M{"UserId": bson.ObjectIdHex(uid)}).Count()
+	if err != nil || n != 0 {
+		t.Fatal("delete user must remove its sessions:", n, err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err == nil {
+		t.Fatal("session of a deleted user must stop working")
+	}
+
+	// the user was impersonated by testManagerImpersonate
+	entries, err := mngr.FindAllAudit(uid, 0)
+	if err != nil || len(entries) == 0 {
+		t.Fatal("delete user must keep its audit entries:", err)
+	}
+
+	u, err := mngr.AddUser("user3@example.com", "zaq123456", true)
+	if err != nil {
+		t.Fatal("cannot create new user:", err)
+	}
+
+	token = mustLogin(t, mngr, *u.Id)
+	err = mngr.UserColl.RemoveId(bson.ObjectIdHex(*u.Id))
+	if err != nil {
+		t.Fatal("cannot remove user:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != authmodel.ErrNotFound {
+		t.Fatal("dangling session must return ErrNotFound, got:", err)
+	}
+
+	_, err = mngr.DeleteUserDetail(*u.Id)
+	if err != authmodel.ErrNotFound {
+		t.Fatal("delete a missing user must return ErrNotFound, got:", err)
+	}
+}
+
+// testManagerBcryptCost hashes a password with the configured bcrypt cost
+// and checks it is hashed again once the cost is raised.
+func testManagerBcryptCost(t *testing.T, dbname string) {
+	mngr := newManager(dbname).(*mgoauth.MgoManager)
+	err := mngr.Config.Set(mgoauth.ConfigBcryptCost, "5")
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+	defer mngr.Config.UnSet(mgoauth.ConfigBcryptCost)
+
+	ps := "zaq123456"
+	u, err := mngr.AddUser("bcrypt@example.com", ps, true)
+	if err != nil {
+		t.Fatal("cannot create new user:", err)
+	}
+
+	cost, err := bcrypt.Cost(u.Pwd.Hashed[len("$bcrypt$v=2$"):])
+	if err != nil || cost != 5 {
+		t.Fatal("password must be hashed with the configured cost:", cost, err)
+	}
+
+	mngr = newManager(dbname).(*mgoauth.MgoManager)
+	err = mngr.Config.Set(mgoauth.ConfigBcryptCost, "6")
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+
+	err = mngr.ComparePassword(ps, u.Pwd)
+	if err != nil {
+		t.Fatal("password hash error:", err)
+	}
+
+	u, err = mngr.FindUser(*u.Id)
+	if err != nil {
+		t.Fatal("cannot find user:", err)
+	}
+
+	cost, err = bcrypt.Cost(u.Pwd.Hashed[len("$bcrypt$v=2$"):])
+	if err != nil || cost != 6 {
+		t.Fatal("password must be rehashed at login:", cost, err)
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, ps, u.Pwd)
+	if err != nil {
+		t.Fatal("rehashed password must still match:", err)
+	}
+
+	if mgoauth.SuggestBcryptCost(time.Millisecond) < bcrypt.DefaultCost {
+		t.Fatal("suggested cost must not be lower than the default")
+	}
+}
+
+// testManagerHasher hashes a password with the configured hasher and
+// checks it is hashed again when the hasher changes.
+func testManagerHasher(t *testing.T, dbname string) {
+	mngr := newManager(dbname).(*mgoauth.MgoManager)
+	err := mngr.Config.SetMulti(map[string]string{
+		mgoauth.ConfigPwdHasher:       mgoauth.HasherArgon2id,
+		mgoauth.ConfigPwdHasherParams: "m=64,t=1,p=1",
+	})
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+	defer mngr.Config.UnSetMulti([]string{
+		mgoauth.ConfigPwdHasher,
+		mgoauth.ConfigPwdHasherParams,
+	})
+
+	ps := "zaq123456"
+	u, err := mngr.AddUser("hasher@example.com", ps, true)
+	if err != nil {
+		t.Fatal("cannot create new user:", err)
+	}
+
+	if !strings.HasPrefix(string(u.Pwd.Hashed), "$argon2id$m=64,t=1,p=1$") {
+		t.Fatal("password must be hashed with the configured hasher:", string(u.Pwd.Hashed))
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, "wrong-password", u.Pwd)
+	if err == nil {
+		t.Fatal("wrong password must not match")
+	}
+
+	for _, c := range []struct{ tag, params string }{
+		{mgoauth.HasherScrypt, "ln=4,r=8,p=1"},
+		{mgoauth.HasherPBKDF2, "i=1000"},
+		{mgoauth.HasherBcrypt, ""},
+	} {
+		mngr = newManager(dbname).(*mgoauth.MgoManager)
+		err = mngr.Config.SetMulti(map[string]string{
+			mgoauth.ConfigPwdHasher:       c.tag,
+			mgoauth.ConfigPwdHasherParams: c.params,
+		})
+		if err != nil {
+			t.Fatal("cannot set config:", err)
+		}
+
+		err = mngr.ComparePasswordDetail(*u.Id, ps, u.Pwd)
+		if err != nil {
+			t.Fatal("password hash error:", err)
+		}
+
+		u, err = mngr.FindUser(*u.Id)
+		if err != nil {
+			t.Fatal("cannot find user:", err)
+		}
+
+		if c.tag != mgoauth.HasherBcrypt &&
+			!strings.HasPrefix(string(u.Pwd.Hashed), "$"+c.tag+"$"+c.params+"$") {
+			t.Fatal("password must be rehashed with", c.tag, "got:", string(u.Pwd.Hashed))
+		}
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, ps, u.Pwd)
+	if err != nil {
+		t.Fatal("password hash error:", err)
+	}
+
+	_, err = mgoauth.NewHasher("md4", "")
+	if err != mgoauth.ErrUnknownHasher {
+		t.Fatal("unknown hasher must be refused:", err)
+	}
+
+	for _, c := range []struct{ tag, params string }{
+		{mgoauth.HasherScrypt, "ln=4,r=32768,p=32768"},
+		{mgoauth.HasherScrypt, "ln=30,r=8,p=1"},
+		{mgoauth.HasherArgon2id, "m=4294967360,t=1,p=1"},
+		{mgoauth.HasherArgon2id, "m=65536,t=4294967296,p=1"},
+	} {
+		_, err = mgoauth.NewHasher(c.tag, c.params)
+		if err != mgoauth.ErrInvalidHasherParams {
+			t.Fatal(c.tag, "parameters over its limits must be refused:", c.params, err)
+		}
+	}
+
+	h, err := mgoauth.NewHasher(mgoauth.HasherScrypt, "")
+	if err != nil {
+		t.Fatal("cannot create hasher:", err)
+	}
+
+	err = h.Compare([]byte("$scrypt$ln=4,r=1,p=1$"), ps, u.Pwd.Salt)
+	if err == nil {
+		t.Fatal("hash without key must not match")
+	}
+}
+
+// testManagerImportUser imports users with legacy password hashes and
+// checks they are replaced at the first login.
+func testManagerImportUser(t *testing.T, mngr *mgoauth.MgoManager) {
+	// openssl passwd -1 -salt saltsalt password
+	u, err := mngr.ImportUser("legacy@example.com", mgoauth.HasherMD5Crypt,
+		"$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/", "", true)
+	if err != nil {
+		t.Fatal("cannot import user:", err)
+	}
+
+	n, err := mngr.CountLegacyPwd()
+	if err != nil || n != 1 {
+		t.Fatal("imported user must be counted as legacy:", n, err)
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, "wrong-password", u.Pwd)
+	if err == nil {
+		t.Fatal("wrong password must not match")
+	}
+
+	err = mngr.ComparePassword("password", u.Pwd)
+	if err != nil {
+		t.Fatal("legacy password must match:", err)
+	}
+
+	u, err = mngr.FindUser(*u.Id)
+	if err != nil {
+		t.Fatal("cannot find user:", err)
+	}
+
+	if strings.HasPrefix(string(u.Pwd.Hashed), "$1$") {
+		t.Fatal("legacy password must be rehashed at login")
+	}
+
+	n, err = mngr.CountLegacyPwd()
+	if err != nil || n != 0 {
+		t.Fatal("rehashed user must not be counted as legacy:", n, err)
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, "password", u.Pwd)
+	if err != nil {
+		t.Fatal("rehashed password must match:", err)
+	}
+
+	// sha1("salt" . "password")
+	u, err = mngr.ImportUserDetail("legacy2@example.com", mgoauth.HasherSHA1SaltPwd,
+		"59b3e8d637cf97edbe2384cf59cb7453dfe30789", "salt", true, []string{"imported"},
+		nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot import user:", err)
+	}
+
+	if len(u.Privileges) != 1 || u.Privileges[0] != "imported" {
+		t.Fatal("import user details failed")
+	}
+
+	err = mngr.ComparePassword("salt", u.Pwd)
+	if err == nil {
+		t.Fatal("wrong password must not match")
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, "password", u.Pwd)
+	if err != nil {
+		t.Fatal("legacy password must match:", err)
+	}
+
+	u, err = mngr.FindUser(*u.Id)
+	if err != nil {
+		t.Fatal("cannot find user:", err)
+	}
+
+	err = mngr.ComparePassword("password", u.Pwd)
+	if err != nil || strings.HasPrefix(string(u.Pwd.Hashed), "$"+mgoauth.HasherSHA1SaltPwd+"$") {
+		t.Fatal("legacy password must be rehashed at login:", err)
+	}
+
+	_, err = mngr.ImportUser("legacy3@example.com", mgoauth.HasherSHA1SaltPwd,
+		"not-a-sha1", "salt", true)
+	if err != authmodel.ErrInvalidPassword {
+		t.Fatal("invalid legacy hash must be refused:", err)
+	}
+}
+
+// testManagerLongPassword checks that passwords longer than 72 bytes are
+// told apart and that first version hashes are upgraded.
+func testManagerLongPassword(t *testing.T, mngr *mgoauth.MgoManager) {
+	ps := strings.Repeat("a", 72) + "first"
+	u, err := mngr.AddUser("long@example.com", ps, true)
+	if err != nil {
+		t.Fatal("cannot create new user:", err)
+	}
+
+	if !strings.HasPrefix(string(u.Pwd.Hashed), "$bcrypt$v=2$") {
+		t.Fatal("password must be hashed with the current version:", string(u.Pwd.Hashed))
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, strings.Repeat("a", 72)+"other", u.Pwd)
+	if err == nil {
+		t.Fatal("passwords sharing 72 bytes must not match")
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, ps, u.Pwd)
+	if err != nil {
+		t.Fatal("password hash error:", err)
+	}
+
+	// hash the password as the first version did
+	tmp := make([]byte, len(ps)+len(u.Pwd.Salt))
+	copy(tmp, ps)
+	tmp = append(tmp, u.Pwd.Salt...)
+	old, err := bcrypt.GenerateFromPassword(tmp, bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatal("cannot hash password:", err)
+	}
+
+	err = mngr.UserColl.UpdateId(bson.ObjectIdHex(*u.Id),
+		bson.M{"$set": bson.M{"Pwd.Hashed": old}})
+	if err != nil {
+		t.Fatal("cannot update user:", err)
+	}
+	u.Pwd.Hashed = old
+
+	err = mngr.ComparePasswordDetail(*u.Id, ps, u.Pwd)
+	if err != nil {
+		t.Fatal("first version hash must still match:", err)
+	}
+
+	u, err = mngr.FindUser(*u.Id)
+	if err != nil {
+		t.Fatal("cannot find user:", err)
+	}
+
+	if !strings.HasPrefix(string(u.Pwd.Hashed), "$bcrypt$v=2$") {
+		t.Fatal("first version hash must be upgraded at login")
+	}
+}
+
+// testManagerPepper hashes a password with a pepper and checks the pepper
+// rotation.
+func testManagerPepper(t *testing.T, dbname string) {
+	peppers, id, err := mgoauth.ParsePeppers(
+		"p2:c2Vjb25kLXBlcHBlci1zZWNyZXQ=\np1:Zmlyc3QtcGVwcGVyLXNlY3JldA==")
+	if err != nil || id != "p2" || len(peppers) != 2 {
+		t.Fatal("cannot parse peppers:", id, err)
+	}
+
+	_, _, err = mgoauth.ParsePeppers("p1:c2hvcnQ=")
+	if err != mgoauth.ErrInvalidPepper {
+		t.Fatal("short pepper must be refused:", err)
+	}
+
+	mngr := newManager(dbname).(*mgoauth.MgoManager)
+	mngr.Peppers = map[string][]byte{"p1": peppers["p1"]}
+	mngr.PepperId = "p1"
+
+	ps := "zaq123456"
+	u, err := mngr.AddUser("pepper@example.com", ps, true)
+	if err != nil {
+		t.Fatal("cannot create new user:", err)
+	}
+
+	if !strings.HasPrefix(string(u.Pwd.Hashed), "$pepper$p1$") {
+		t.Fatal("password must be hashed with the pepper:", string(u.Pwd.Hashed))
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, ps, u.Pwd)
+	if err != nil {
+		t.Fatal("password hash error:", err)
+	}
+
+	mngr = newManager(dbname).(*mgoauth.MgoManager)
+	mngr.Peppers = nil
+	mngr.PepperId = ""
+	err = mngr.ComparePasswordDetail(*u.Id, ps, u.Pwd)
+	if err != mgoauth.ErrUnknownPepper {
+		t.Fatal("password must not be checked without its pepper:", err)
+	}
+
+	mngr.Peppers = peppers
+	mngr.PepperId = id
+	err = mngr.ComparePasswordDetail(*u.Id, ps, u.Pwd)
+	if err != nil {
+		t.Fatal("old pepper must still be checked:", err)
+	}
+
+	u, err = mngr.FindUser(*u.Id)
+	if err != nil {
+		t.Fatal("cannot find user:", err)
+	}
+
+	if !strings.HasPrefix(string(u.Pwd.Hashed), "$pepper$p2$") {
+		t.Fatal("password must be rehashed with the current pepper at login")
+	}
+
+	err = mngr.ComparePasswordDetail(*u.Id, ps, u.Pwd)
+	if err != nil {
+		t.Fatal("rehashed password must match:", err)
+	}
+}
+
+// testManagerPwdHistory refuses the reuse of the last passwords.
+func testManagerPwdHistory(t *testing.T, dbname string) {
+	mngr := newManager(dbname).(*mgoauth.MgoManager)
+	err := mngr.Config.Set(mgoauth.ConfigPwdHistory, "3")
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+	defer mngr.Config.UnSet(mgoauth.ConfigPwdHistory)
+
+	u, err := mngr.AddUser("history@example.com", "password0", true)
+	if err != nil {
+		t.Fatal("cannot create new user:", err)
+	}
+
+	change := func(pwd string) error {
+		return mngr.UpdateUserDetail(*u.Id, &pwd, nil, nil, nil, nil, nil)
+	}
+
+	for _, pwd := range []string{"password0", "password1", "password0"} {
+		err = change(pwd)
+		if pwd == "password1" {
+			if err != nil {
+				t.Fatal("cannot change password:", err)
+			}
+			continue
+		}
+
+		if e, ok := err.(*mgoauth.PasswordReusedError); !ok || e.History != 3 {
+			t.Fatal("reused password must be refused:", err)
+		}
+	}
+
+	for _, pwd := range []string{"password2", "password3", "password0"} {
+		err = change(pwd)
+		if err != nil {
+			t.Fatal("password out of the history must be accepted:", err)
+		}
+	}
+
+	user := &mgoauth.User{}
+	err = mngr.UserColl.FindId(bson.ObjectIdHex(*u.Id)).One(user)
+	if err != nil {
+		t.Fatal("cannot find user:", err)
+	}
+
+	if len(user.PwdHistory) != 2 {
+		t.Fatal("password history must be pruned:", len(user.PwdHistory))
+	}
+}
+
+// testManagerPwdExpiry expires an old password and checks the group
+// policy override and the password change.
+func testManagerPwdExpiry(t *testing.T, dbname string) {
+	mngr := newManager(dbname).(*mgoauth.MgoManager)
+	err := mngr.Config.SetMulti(map[string]string{
+		mgoauth.ConfigPwdMaxAge:        "1h",
+		mgoauth.ConfigPwdExpiryWarning: "2h",
+	})
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+	defer mngr.Config.UnSetMulti([]string{
+		mgoauth.ConfigPwdMaxAge,
+		mgoauth.ConfigPwdExpiryWarning,
+	})
+
+	u, err := mngr.AddUser("expiry@example.com", "zaq123456", true)
+	if err != nil {
+		t.Fatal("cannot create new user:", err)
+	}
+
+	jwt, err := mngr.IssueJWT(*u.Id, time.Minute)
+	if err != nil {
+		t.Fatal("cannot issue JWT:", err)
+	}
+
+	err = mngr.UserColl.UpdateId(bson.ObjectIdHex(*u.Id), bson.M{
+		"$set": bson.M{"Pwd.InitAt": time.Now().Add(-2 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal("cannot update user:", err)
+	}
+
+	expiry, err := mngr.FindPwdExpiry(*u.Id)
+	if err != nil {
+		t.Fatal("cannot find password expiry:", err)
+	}
+
+	if !expiry.Expired {
+		t.Fatal("password older than the max age must expire")
+	}
+
+	token, err := mngr.Login(*u.Id, time.Hour)
+	if err != nil {
+		t.Fatal("cannot login:", err)
+	}
+
+	_, state, err := mngr.GetUserDetail(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	if !state.PwdExpired {
+		t.Fatal("session must tell the password expired")
+	}
+
+	fn := mgoauth.RequireFreshPwd(func(*auth.AuthContext, http.ResponseWriter,
+		*http.Request) (int, error) {
+		return http.StatusOK, nil
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	status, err := fn(&auth.AuthContext{Auth: mngr}, httptest.NewRecorder(), req)
+	if status != http.StatusForbidden || err != mgoauth.ErrPasswordExpired {
+		t.Fatal("expired password must be changed first:", status, err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	status, err = fn(&auth.AuthContext{Auth: mngr}, httptest.NewRecorder(), req)
+	if status != http.StatusForbidden || err != mgoauth.ErrPasswordExpired {
+		t.Fatal("JWT with an expired password must be refused:", status, err)
+	}
+
+	req.Header.Set("Authorization", "Bearer invalid")
+	status, err = fn(&auth.AuthContext{Auth: mngr}, httptest.NewRecorder(), req)
+	if status != http.StatusUnauthorized || err == nil {
+		t.Fatal("token which cannot be checked must be refused:", status, err)
+	}
+
+	_, refresh, err := mngr.LoginWithRefresh(*u.Id, time.Hour)
+	if err != nil {
+		t.Fatal("cannot login:", err)
+	}
+
+	access, _, err := mngr.Refresh(refresh)
+	if err != nil {
+		t.Fatal("cannot refresh:", err)
+	}
+
+	_, state, err = mngr.GetUserDetail(access)
+	if err != nil || !state.PwdExpired {
+		t.Fatal("refreshed session must tell the password expired:", err)
+	}
+
+	_, err = mngr.IssueJWT(*u.Id, time.Minute)
+	if err != mgoauth.ErrPasswordExpired {
+		t.Fatal("JWT must not be issued with an expired password:", err)
+	}
+
+	g, err := mngr.AddGroupDetail("no-expiry", nil, nil)
+	if err != nil {
+		t.Fatal("cannot add group:", err)
+	}
+
+	never := time.Duration(0)
+	err = mngr.UpdateGroupPolicy(*g.Id, &mgoauth.GroupPolicy{PwdMaxAge: &never})
+	if err != nil {
+		t.Fatal("cannot update group policy:", err)
+	}
+
+	err = mngr.UpdateUserDetail(*u.Id, nil, nil, nil, nil, nil, []string{*g.Id})
+	if err != nil {
+		t.Fatal("cannot update user detail:", err)
+	}
+
+	expiry, err = mngr.FindPwdExpiry(*u.Id)
+	if err != nil || expiry.Expired || !expiry.ExpiredOn.IsZero() {
+		t.Fatal("group policy must override the max age:", expiry, err)
+	}
+
+	_, state, err = mngr.GetUserDetail(token)
+	if err != nil || state.PwdExpired {
+		t.Fatal("group change must reach the live sessions:", err)
+	}
+
+	maxAge := time.Hour
+	err = mngr.UpdateGroupPolicy(*g.Id, &mgoauth.GroupPolicy{PwdMaxAge: &maxAge})
+	if err != nil {
+		t.Fatal("cannot update group policy:", err)
+	}
+
+	_, state, err = mngr.GetUserDetail(token)
+	if err != nil || !state.PwdExpired {
+		t.Fatal("group policy change must reach the live sessions:", err)
+	}
+
+	err = mngr.UpdateUserDetail(*u.Id, nil, nil, nil, nil, nil, []string{})
+	if err != nil {
+		t.Fatal("cannot update user detail:", err)
+	}
+
+	pwd := "zaq654321"
+	err = mngr.UpdateUserDetail(*u.Id, &pwd, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot change password:", err)
+	}
+
+	_, state, err = mngr.GetUserDetail(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	if state.PwdExpired {
+		t.Fatal("password change must clear the expiry of the sessions")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	status, err = fn(&auth.AuthContext{Auth: mngr}, httptest.NewRecorder(), req)
+	if status != http.StatusOK || err != nil {
+		t.Fatal("changed password must be accepted:", status, err)
+	}
+
+	expiry, err = mngr.FindPwdExpiry(*u.Id)
+	if err != nil || expiry.Expired || !expiry.Warning {
+		t.Fatal("new password within the warning window must warn:", expiry, err)
+	}
+
+	// the max age is lowered while the session lasts
+	err = mngr.Config.Set(mgoauth.ConfigPwdMaxAge, "1ns")
+	if err != nil {
+		t.Fatal("cannot set config:", err)
+	}
+
+	_, state, err = mngr.GetUserDetail(token)
+	if err != nil || !state.PwdExpired {
+		t.Fatal("max age change must reach the live sessions:", err)
+	}
+}
+
+// testManagerBus checks that a logout on one node evicts the session cached
+// by another node.
+func testManagerBus(t *testing.T, dbname, uid string) {
+	nodes := make([]*mgoauth.MgoManager, 2)
+	for i := range nodes {
+		m := newManager(dbname).(*mgoauth.MgoManager)
+		m.Cache = mgoauth.NewSessionCache(10, time.Hour)
+		m.Bus = mgoauth.NewInvalidationBus(m.UserColl.Database, m.Cache)
+		defer m.Bus.Close()
+		nodes[i] = m
+	}
+
+	for deadline := time.Now().Add(time.Second); !nodes[1].Bus.Tailing(); {
+		if time.Now().After(deadline) {
+			t.Fatal("bus must tail the events")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	token := mustLogin(t, nodes[0], uid)
+	_, err := nodes[1].GetUser(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	err = nodes[0].Logout(token, false)
+	if err != nil {
+		t.Fatal("cannot logout user:", err)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		_, err = nodes[1].GetUser(token)
+		if err != nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("logout must reach the cache of the other nodes")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func mustLogin(t *testing.T, mngr authmodel.Manager, uid string) string {
+	token, err := mngr.Login(uid, time.Hour)
+	if err != nil {
+		t.Fatal("cannot login:", err)
+	}
+
+	return token
+}
+
+// testManagerSessionLimit limits the user to a single session through a
+// group policy and checks both limit modes.
+func testManagerSessionLimit(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	g, err := mngr.AddGroupDetail("limited", nil, nil)
+	if err != nil {
+		t.Fatal("cannot create new group:", err)
+	}
+
+	max, mode := 1, mgoauth.SessionLimitRefuse
+	err = mngr.UpdateGroupPolicy(*g.Id, &mgoauth.GroupPolicy{
+		MaxSessions:      &max,
+		SessionLimitMode: &mode,
+	})
+	if err != nil {
+		t.Fatal("cannot update group policy:", err)
+	}
+
+	err = mngr.UpdateUserDetail(uid, nil, nil, nil, nil, nil, []string{*g.Id})
+	if err != nil {
+		t.Fatal("cannot update user detail:", err)
+	}
+
+	err = mngr.Logout(mustLogin(t, mngr, uid), true)
+	if err != nil {
+		t.Fatal("cannot logout user:", err)
+	}
+
+	token := mustLogin(t, mngr, uid)
+	_, err = mngr.Login(uid, time.Hour)
+	if _, ok := err.(*mgoauth.SessionLimitError); !ok {
+		t.Fatal("must refuse logins over the session limit:", err)
+	}
+
+	mode = mgoauth.SessionLimitEvict
+	err = mngr.UpdateGroupPolicy(*g.Id, &mgoauth.GroupPolicy{
+		MaxSessions:      &max,
+		SessionLimitMode: &mode,
+	})
+	if err != nil {
+		t.Fatal("cannot update group policy:", err)
+	}
+
+	mustLogin(t, mngr, uid)
+	_, err = mngr.GetUser(token)
+	if err == nil {
+		t.Fatal("must evict the oldest session over the session limit")
+	}
+
+	err = mngr.DeleteGroup(*g.Id)
+	if err != nil {
+		t.Fatal("delete group failed:", err)
+	}
+}
+
+// testManagerExpiry moves the expiry of sessions around the current time and
+// checks that GetUser rejects expired tokens even before the TTL index
+// removes them.
+func testManagerExpiry(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	setExpiry := func(field string, exp time.Time) {
+		sessions, err := mngr.FindAllSession(uid)
+		if err != nil {
+			t.Fatal("cannot list sessions:", err)
+		}
+
+		// the newest session belongs to the token just created
+		err = mngr.LoginColl.Update(bson.M{"SessionId": sessions[0].SessionId},
+			bson.M{"$set": bson.M{field: exp}})
+		if err != nil {
+			t.Fatal("cannot update session:", err)
+		}
+	}
+
+	err := mngr.Logout(mustLogin(t, mngr, uid), true)
+	if err != nil {
+		t.Fatal("cannot logout user:", err)
+	}
+
+	token := mustLogin(t, mngr, uid)
+	setExpiry("ExpiredOn", time.Now().Add(time.Second))
+	_, err = mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("token must be valid until it expires:", err)
+	}
+
+	setExpiry("ExpiredOn", time.Now())
+	_, err = mngr.GetUser(token)
+	if err != mgoauth.ErrSessionExpired {
+		t.Fatal("token must be rejected when it expires:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != authmodel.ErrNotLogged {
+		t.Fatal("expired session must be removed:", err)
+	}
+
+	token, refresh, err := mngr.LoginWithRefresh(uid, time.Hour)
+	if err != nil {
+		t.Fatal("cannot login:", err)
+	}
+
+	setExpiry("TokenExpiredOn", time.Now().Add(-time.Millisecond))
+	_, err = mngr.GetUser(token)
+	if err != mgoauth.ErrSessionExpired {
+		t.Fatal("access token must be rejected when it expires:", err)
+	}
+
+	token, _, err = mngr.Refresh(refresh)
+	if err != nil {
+		t.Fatal("session must be refreshable after the access token expires:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("cannot get logged user with refreshed token:", err)
+	}
+}
+
+// testManagerActivity checks that LastActivity updates go through the
+// ActivityWriter and are throttled by ActivityGranularity.
+func testManagerActivity(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	activity := mgoauth.NewActivityWriter(mngr.UserColl.Database, time.Hour)
+	defer activity.Close()
+
+	mngr.ActivityGranularity = time.Minute
+	mngr.Activity = activity
+	defer func() {
+		mngr.ActivityGranularity = 0
+		mngr.Activity = nil
+	}()
+
+	past := time.Now().Add(-time.Hour)
+	err := mngr.UserColl.UpdateId(bson.ObjectIdHex(uid),
+		bson.M{"$set": bson.M{"LastActivity": past}})
+	if err != nil {
+		t.Fatal("cannot update user:", err)
+	}
+
+	_, err = mngr.GetUser(mustLogin(t, mngr, uid))
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	u, err := mngr.FindUser(uid)
+	if err != nil {
+		t.Fatal("cannot find user:", err)
+	}
+
+	if u.LastActivity.After(past.Add(time.Second)) {
+		t.Fatal("LastActivity must not be written before the flush")
+	}
+
+	err = activity.Flush()
+	if err != nil {
+		t.Fatal("cannot flush activity:", err)
+	}
+
+	u, err = mngr.FindUser(uid)
+	if err != nil {
+		t.Fatal("cannot find user:", err)
+	}
+
+	if time.Since(*u.LastActivity) > time.Minute {
+		t.Fatal("LastActivity not updated by the flush")
+	}
+}
+
+// testManagerOnline makes the user inactive and checks that it leaves the
+// online users.
+func testManagerOnline(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	_, err := mngr.GetUser(mustLogin(t, mngr, uid))
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	n, err := mngr.CountUserOnline(nil)
+	if err != nil {
+		t.Fatal("cannot count online users:", err)
+	}
+
+	users, err := mngr.FindAllUserOnline(-1, "", []string{"Id"})
+	if err != nil {
+		t.Fatal("cannot find online users:", err)
+	}
+
+	if len(users) != n {
+		t.Fatal("online users count mismatch, expect", n, "found", len(users))
+	}
+
+	err = mngr.UserColl.UpdateId(bson.ObjectIdHex(uid), bson.M{"$set": bson.M{
+		"LastActivity": time.Now().Add(-mngr.MinimumOnlineThreshold - time.Second),
+	}})
+	if err != nil {
+		t.Fatal("cannot update user:", err)
+	}
+
+	users, err = mngr.FindAllUserOnline(-1, "", []string{"Id"})
+	if err != nil {
+		t.Fatal("cannot find online users:", err)
+	}
+
+	if len(users) != n-1 {
+		t.Fatal("inactive user must not be online, expect", n-1, "found", len(users))
+	}
+
+	for _, u := range users {
+		if *u.Id == uid {
+			t.Fatal("inactive user must not be online")
+		}
+	}
+}
+
+// testManagerCache checks that cached sessions are invalidated by Logout and
+// user updates.
+func testManagerCache(t *testing.T, mngr *mgoauth.MgoManager, uid string) {
+	mngr.Cache = mgoauth.NewSessionCache(10, time.Minute)
+	defer func() {
+		mngr.Cache = nil
+	}()
+
+	token := mustLogin(t, mngr, uid)
+	for i := 0; i < 2; i++ {
+		_, err := mngr.GetUser(token)
+		if err != nil {
+			t.Fatal("cannot get logged user:", err)
+		}
+	}
+
+	err := mngr.UpdateUserDetail(uid, nil, nil, []string{"cached"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot update user detail:", err)
+	}
+
+	u, err := mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	if len(u.Privileges) != 1 || u.Privileges[0] != "cached" {
+		t.Fatal("user update must invalidate the cache")
+	}
+
+	u.Privileges[0] = "changed"
+	u, err = mngr.GetUser(token)
+	if err != nil {
+		t.Fatal("cannot get logged user:", err)
+	}
+
+	if u.Privileges[0] != "cached" {
+		t.Fatal("cached user must not share its privileges with the callers")
+	}
+
+	err = mngr.Logout(token, false)
+	if err != nil {
+		t.Fatal("cannot logout user:", err)
+	}
+
+	_, err = mngr.GetUser(token)
+	if err == nil {
+		t.Fatal("logout must invalidate the cache")
+	}
+}
@@ -0,0 +1,311 @@
+package mgoauth
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/gorilla/securecookie"
+	"github.com/kidstuff/auth/authmodel"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"strconv"
+	"time"
+)
+
+// saltedPwd returns the bytes hashed for the password pwd by the first
+// version of the bcrypt hashes.
+func saltedPwd(pwd string, salt []byte) []byte {
+	pwdBytes := []byte(pwd)
+	tmp := make([]byte, len(pwdBytes)+len(salt))
+	copy(tmp, pwdBytes)
+	return append(tmp, salt...)
+}
+
+// bcryptCost returns the cost of the new password hashes, ConfigBcryptCost
+// or bcrypt.DefaultCost.
+func (m *MgoManager) bcryptCost() int {
+	cost := m.settingInt(ConfigBcryptCost, bcrypt.DefaultCost)
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return bcrypt.DefaultCost
+	}
+
+	return cost
+}
+
+// hasher returns the hasher of the new passwords, ConfigPwdHasher with
+// ConfigPwdHasherParams.
+func (m *MgoManager) hasher() (Hasher, error) {
+	tag := m.setting(ConfigPwdHasher)
+	if tag == "" {
+		tag = HasherBcrypt
+	}
+
+	params := m.setting(ConfigPwdHasherParams)
+	if tag == HasherBcrypt && params == "" {
+		params = "cost=" + strconv.Itoa(m.bcryptCost())
+	}
+
+	return NewHasher(tag, params)
+}
+
+func (m *MgoManager) hashPwd(pwd string) (authmodel.Password, error) {
+	p := authmodel.Password{}
+	p.InitAt = time.Now()
+	p.Salt = securecookie.GenerateRandomKey(32)
+	if m.pepperErr != nil {
+		return p, m.pepperErr
+	}
+
+	h, err := m.hasher()
+	if err != nil {
+		return p, err
+	}
+
+	if m.PepperId == "" {
+		p.Hashed, err = h.Hash(pwd, p.Salt)
+		return p, err
+	}
+
+	pepper, ok := m.Peppers[m.PepperId]
+	if !ok {
+		return p, ErrUnknownPepper
+	}
+
+	b, err := h.Hash(pepperPwd(pepper, pwd), p.Salt)
+	if err != nil {
+		return p, err
+	}
+
+	p.Hashed = append([]byte(pepperPrefix+m.PepperId), b...)
+	return p, nil
+}
+
+// ComparePassword checks ps against the hashed password pwd with the hasher
+// and pepper which made it. A password not hashed with the current hasher,
+// parameters and pepper is hashed again and stored, pwd is then updated.
+// The user is found by its hash and salt, which only match the user the
+// password of which is ps.
+func (m *MgoManager) ComparePassword(ps string, pwd *authmodel.Password) error {
+	return m.comparePassword(bson.M{"Pwd.Hashed": pwd.Hashed, "Pwd.Salt": pwd.Salt}, ps, pwd)
+}
+
+// ComparePasswordDetail works like ComparePassword for the password pwd of
+// the user id.
+func (m *MgoManager) ComparePasswordDetail(id, ps string, pwd *authmodel.Password) error {
+	oid, err := getId(id)
+	if err != nil {
+		return err
+	}
+
+	return m.comparePassword(bson.M{"_id": oid, "Pwd.Hashed": pwd.Hashed}, ps, pwd)
+}
+
+// comparePassword checks ps against pwd and upgrades the hash of the user
+// matching query if needed.
+func (m *MgoManager) comparePassword(query bson.M, ps string, pwd *authmodel.Password) error {
+	rehash, err := m.comparePwd(ps, pwd)
+	if err != nil {
+		return err
+	}
+
+	if rehash {
+		// the password is right, a failed upgrade is retried at next login
+		m.rehashPwd(query, ps, pwd)
+	}
+
+	return nil
+}
+
+// comparePwd checks ps against the hashed password pwd and reports whether
+// pwd is not hashed with the current hasher, parameters and pepper.
+func (m *MgoManager) comparePwd(ps string, pwd *authmodel.Password) (bool, error) {
+	if m.pepperErr != nil {
+		return false, m.pepperErr
+	}
+
+	id, hashed := splitPepper(pwd.Hashed)
+	peppered := ps
+	if id != "" {
+		pepper, ok := m.Peppers[id]
+		if !ok {
+			return false, ErrUnknownPepper
+		}
+		peppered = pepperPwd(pepper, ps)
+	}
+
+	h, err := NewHasher(hasherTag(hashed), "")
+	if err != nil {
+		return false, err
+	}
+
+	err = h.Compare(hashed, peppered, pwd.Salt)
+	if err != nil {
+		return false, err
+	}
+
+	h, err = m.hasher()
+	return err == nil && (id != m.PepperId || h.NeedsRehash(hashed)), nil
+}
+
+// rehashPwd replaces the hash pwd of the password ps of the user matching
+// query. query must include the stored hash, so a password changed
+// meanwhile is not overwritten.
+func (m *MgoManager) rehashPwd(query bson.M, ps string, pwd *authmodel.Password) error {
+	p, err := m.hashPwd(ps)
+	if err != nil {
+		return err
+	}
+	// the password itself did not change
+	p.InitAt = pwd.InitAt
+
+	err = m.UserColl.Update(query,
+		bson.M{"$set": bson.M{"Pwd": p}, "$unset": bson.M{"LegacyPwd": ""}})
+	if err != nil {
+		return err
+	}
+
+	*pwd = p
+	return nil
+}
+
+// PasswordReusedError is returned when a new password is one of the last
+// History passwords of the user.
+type PasswordReusedError struct {
+	History int
+}
+
+func (e *PasswordReusedError) Error() string {
+	return "mgoauth: the password is one of the last " +
+		strconv.Itoa(e.History) + " passwords"
+}
+
+// checkPwdHistory returns a *PasswordReusedError if pwd is the current
+// password of the user or in its history. Otherwise it adds to update, which
+// must have an $unset, the changes keeping the current password in the
+// history before it is replaced by pwd.
+func (m *MgoManager) checkPwdHistory(oid bson.ObjectId, pwd string, update bson.M) error {
+	n := m.settingInt(ConfigPwdHistory, 0)
+	if n <= 0 {
+		update["$unset"].(bson.M)["PwdHistory"] = ""
+		return nil
+	}
+
+	u := &User{}
+	err := m.UserColl.FindId(oid).Select(bson.M{"Pwd": 1, "PwdHistory": 1}).One(u)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return authmodel.ErrNotFound
+		}
+		return err
+	}
+
+	if u.Pwd == nil {
+		return nil
+	}
+
+	// the history holds the n - 1 passwords before the current one
+	if len(u.PwdHistory) > n-1 {
+		u.PwdHistory = u.PwdHistory[len(u.PwdHistory)-(n-1):]
+	}
+	for _, p := range append(u.PwdHistory, *u.Pwd) {
+		// the passwords which cannot be checked, such as the ones with a
+		// removed pepper, are not counted as reused
+		if _, err := m.comparePwd(pwd, &p); err == nil {
+			return &PasswordReusedError{n}
+		}
+	}
+
+	update["$push"] = bson.M{"PwdHistory": bson.M{
+		"$each":  []authmodel.Password{*u.Pwd},
+		"$slice": -(n - 1),
+	}}
+	return nil
+}
+
+// PwdExpiry tells when the password of a user expires.
+type PwdExpiry struct {
+	// ExpiredOn is zero if the password does not expire.
+	ExpiredOn time.Time
+	// Expired is set once ExpiredOn is past, the sessions of the user are
+	// then marked with LoginState.PwdExpired until the password changes.
+	Expired bool
+	// Warning is set within ConfigPwdExpiryWarning before ExpiredOn.
+	Warning bool
+}
+
+// pwdMaxAge returns the maximum age of the passwords of a user with the
+// group policies.
+func (m *MgoManager) pwdMaxAge(policies []*GroupPolicy) time.Duration {
+	maxAge := m.settingDuration(ConfigPwdMaxAge, 0)
+
+	set := false
+	for _, p := range policies {
+		if p.PwdMaxAge != nil {
+			if !set || maxAge > 0 && (*p.PwdMaxAge <= 0 || *p.PwdMaxAge > maxAge) {
+				maxAge = *p.PwdMaxAge
+			}
+			set = true
+		}
+	}
+
+	return maxAge
+}
+
+// pwdExpiry returns when pwd expires with the group policies of its user.
+func (m *MgoManager) pwdExpiry(pwd *authmodel.Password, policies []*GroupPolicy) *PwdExpiry {
+	expiry := &PwdExpiry{}
+	maxAge := m.pwdMaxAge(policies)
+	if maxAge <= 0 || pwd == nil || pwd.InitAt.IsZero() {
+		return expiry
+	}
+
+	now := time.Now()
+	expiry.ExpiredOn = pwd.InitAt.Add(maxAge)
+	expiry.Expired = !expiry.ExpiredOn.After(now)
+	expiry.Warning = !expiry.Expired &&
+		expiry.ExpiredOn.Sub(now) <= m.settingDuration(ConfigPwdExpiryWarning, 0)
+	return expiry
+}
+
+// FindPwdExpiry returns when the password of the user expires, from
+// ConfigPwdMaxAge or its group policies, and whether it must be changed.
+func (m *MgoManager) FindPwdExpiry(id string) (*PwdExpiry, error) {
+	oid, err := getId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &User{}
+	err = m.UserColl.FindId(oid).Select(bson.M{"Pwd.InitAt": 1, "Groups.Id": 1}).One(u)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, authmodel.ErrNotFound
+		}
+		return nil, err
+	}
+
+	policies, err := m.groupPolicies(u.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.pwdExpiry(u.Pwd, policies), nil
+}
+
+// SuggestBcryptCost returns the highest bcrypt cost hashing a password in
+// less than target on this machine, at least bcrypt.DefaultCost. The
+// result is meant for ConfigBcryptCost, it takes about twice target to run.
+func SuggestBcryptCost(target time.Duration) int {
+	pwd := (&bcryptHasher{}).preHash("mgoauth-benchmark", securecookie.GenerateRandomKey(32))
+	cost := bcrypt.DefaultCost
+	for c := bcrypt.MinCost; c <= bcrypt.MaxCost; c++ {
+		start := time.Now()
+		_, err := bcrypt.GenerateFromPassword(pwd, c)
+		if err != nil || time.Since(start) > target {
+			break
+		}
+		if c > cost {
+			cost = c
+		}
+	}
+
+	return cost
+}
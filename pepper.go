@@ -0,0 +1,108 @@
+package mgoauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownPepper = errors.New("mgoauth: the password pepper is not available")
+	ErrInvalidPepper = errors.New("mgoauth: invalid password pepper")
+
+	errPepperConflict = errors.New("mgoauth: both MGOAUTH_PEPPER and MGOAUTH_PEPPER_FILE are set")
+)
+
+// pepperPrefix starts the hashes made with a pepper, "$pepper$<id>$" is
+// followed by the hash of the peppered password.
+const pepperPrefix = "$pepper$"
+
+// ParsePeppers parses a comma or new line separated list of "<id>:<base64
+// secret>" peppers. The first one is the current pepper, the others are
+// kept to check the passwords hashed with them.
+func ParsePeppers(s string) (map[string][]byte, string, error) {
+	peppers := make(map[string][]byte)
+	current := ""
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	}) {
+		entry = strings.TrimSpace(entry)
+		i := strings.Index(entry, ":")
+		if i <= 0 || strings.Contains(entry[:i], "$") {
+			return nil, "", ErrInvalidPepper
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(entry[i+1:])
+		if err != nil || len(secret) < 16 {
+			return nil, "", ErrInvalidPepper
+		}
+
+		if current == "" {
+			current = entry[:i]
+		}
+		peppers[entry[:i]] = secret
+	}
+
+	return peppers, current, nil
+}
+
+var (
+	envPeppersOnce sync.Once
+	envPeppers     map[string][]byte
+	envPepperId    string
+	envPepperErr   error
+)
+
+// loadEnvPeppers returns the peppers of the MGOAUTH_PEPPER environment
+// variable or of the file named by MGOAUTH_PEPPER_FILE, read once.
+func loadEnvPeppers() (map[string][]byte, string, error) {
+	envPeppersOnce.Do(func() {
+		s := os.Getenv("MGOAUTH_PEPPER")
+		if name := os.Getenv("MGOAUTH_PEPPER_FILE"); name != "" {
+			if s != "" {
+				envPepperErr = errPepperConflict
+				return
+			}
+
+			b, err := ioutil.ReadFile(name)
+			if err != nil {
+				envPepperErr = err
+				return
+			}
+			s = string(b)
+		}
+
+		envPeppers, envPepperId, envPepperErr = ParsePeppers(s)
+	})
+
+	return envPeppers, envPepperId, envPepperErr
+}
+
+// pepperPwd returns the password pwd mixed with pepper, to be hashed.
+func pepperPwd(pepper []byte, pwd string) string {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(pwd))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// splitPepper returns the pepper id of hashed, empty if it was made without
+// pepper, and the hash of the password.
+func splitPepper(hashed []byte) (string, []byte) {
+	if !bytes.HasPrefix(hashed, []byte(pepperPrefix)) {
+		return "", hashed
+	}
+
+	rest := hashed[len(pepperPrefix):]
+	i := bytes.IndexByte(rest, '$')
+	if i < 0 {
+		return "", hashed
+	}
+
+	return string(rest[:i]), rest[i:]
+}
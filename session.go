@@ -0,0 +1,525 @@
+package mgoauth
+
+import (
+	"github.com/kidstuff/auth/authmodel"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxUsedRefreshTokens is how many rotated out refresh tokens a session
+	// remembers for reuse detection.
+	maxUsedRefreshTokens = 20
+	// lastSeenGranularity is how often GetUser updates LoginState.LastSeen.
+	lastSeenGranularity = time.Minute
+)
+
+// Session limit modes, see ConfigSessionLimitMode.
+const (
+	SessionLimitEvict  = "evict"
+	SessionLimitRefuse = "refuse"
+)
+
+// Authentication methods of a session, see LoginState.AuthMethod.
+const (
+	AuthPassword      = "password"
+	AuthMFA           = "mfa"
+	AuthImpersonation = "impersonation"
+)
+
+// Assurance levels of the authentication methods.
+const (
+	AuthLevelNone     = 0
+	AuthLevelPassword = 1
+	AuthLevelMFA      = 2
+)
+
+// authLevel returns the assurance level of the authentication method.
+func authLevel(method string) int {
+	switch method {
+	case AuthPassword:
+		return AuthLevelPassword
+	case AuthMFA:
+		return AuthLevelMFA
+	}
+	return AuthLevelNone
+}
+
+// LoginInfo describes the client a session is created for.
+type LoginInfo struct {
+	IP        string
+	UserAgent string
+	// Device is a label chosen by the application or the user, such as
+	// "Work laptop".
+	Device string
+	// AuthMethod is how the user authenticated, AuthPassword if empty.
+	AuthMethod string
+}
+
+// NewLoginInfo returns the LoginInfo of the client sending req.
+func NewLoginInfo(req *http.Request, device string) *LoginInfo {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	return &LoginInfo{
+		IP:        ip,
+		UserAgent: req.UserAgent(),
+		Device:    device,
+	}
+}
+
+// deadline returns the idle deadline of the session if it is used at now.
+func (s *LoginState) deadline(now time.Time) time.Time {
+	if s.IdleTimeout <= 0 {
+		return s.ExpiredOn
+	}
+
+	exp := now.Add(s.IdleTimeout)
+	if !s.AbsoluteExpiredOn.IsZero() && exp.After(s.AbsoluteExpiredOn) {
+		return s.AbsoluteExpiredOn
+	}
+
+	return exp
+}
+
+// newLoginState returns a new session of the user oid which lasts at most
+// stay, and the token of that session.
+func (m *MgoManager) newLoginState(oid bson.ObjectId, stay time.Duration,
+	info *LoginInfo) (*LoginState, string) {
+	if stay < m.MinimumOnlineThreshold {
+		stay = m.MinimumOnlineThreshold
+	}
+
+	now := time.Now()
+	token := newToken()
+	state := &LoginState{
+		AbsoluteExpiredOn: now.Add(stay),
+		IdleTimeout:       m.IdleTimeout,
+		UserId:            oid,
+		SessionId:         bson.NewObjectId(),
+		Token:             m.hashToken(token),
+		Hashed:            true,
+		CreatedOn:         now,
+		LastSeen:          now,
+		AuthMethod:        AuthPassword,
+		AuthOn:            now,
+	}
+	if info != nil {
+		state.IP = info.IP
+		state.UserAgent = info.UserAgent
+		state.Device = info.Device
+		if info.AuthMethod != "" {
+			state.AuthMethod = info.AuthMethod
+		}
+	}
+	state.AuthLevel = authLevel(state.AuthMethod)
+	// the idle deadline slides back from the absolute one
+	state.ExpiredOn = state.AbsoluteExpiredOn
+	state.ExpiredOn = state.deadline(now)
+
+	return state, token
+}
+
+// sessionLimit returns the maximum number of sessions of a user with the
+// group policies and what to do when it is reached. Zero means no limit.
+func (m *MgoManager) sessionLimit(policies []*GroupPolicy) (int, string) {
+	limit := m.settingInt(ConfigMaxSessions, 0)
+	mode := m.setting(ConfigSessionLimitMode)
+
+	limitSet, modeSet := false, false
+	for _, p := range policies {
+		if p.MaxSessions != nil {
+			if !limitSet || limit > 0 && (*p.MaxSessions <= 0 || *p.MaxSessions > limit) {
+				limit = *p.MaxSessions
+			}
+			limitSet = true
+		}
+		if p.SessionLimitMode != nil {
+			if !modeSet || *p.SessionLimitMode != SessionLimitRefuse {
+				mode = *p.SessionLimitMode
+			}
+			modeSet = true
+		}
+	}
+
+	return limit, mode
+}
+
+// limitSession makes room for a new session of the user when the session
+// limit is reached by removing the oldest ones, or returns a
+// *SessionLimitError if the limit mode is SessionLimitRefuse.
+func (m *MgoManager) limitSession(oid bson.ObjectId, policies []*GroupPolicy) error {
+	limit, mode := m.sessionLimit(policies)
+	if limit <= 0 {
+		return nil
+	}
+
+	states := []*LoginState{}
+	err := m.LoginColl.Find(bson.M{
+		"UserId":    oid,
+		"ExpiredOn": bson.M{"$gt": time.Now()},
+	}).Select(bson.M{"_id": 1}).Sort("CreatedOn").All(&states)
+	if err != nil {
+		return err
+	}
+
+	n := len(states) - limit + 1
+	if n <= 0 {
+		return nil
+	}
+
+	if mode == SessionLimitRefuse {
+		return &SessionLimitError{limit}
+	}
+
+	ids := make([]string, 0, n)
+	for _, s := range states[:n] {
+		ids = append(ids, s.Token)
+	}
+	_, err = m.LoginColl.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	m.invalidateUser(oid)
+	return err
+}
+
+// LoginWithRefresh works like Login but returns a short lived token, which
+// lasts for AccessTokenTTL, and a refresh token which can be exchanged for a
+// new pair by Refresh until the session ends.
+func (m *MgoManager) LoginWithRefresh(id string, stay time.Duration) (string,
+	string, error) {
+	return m.LoginDetail(id, stay, true, nil)
+}
+
+// LoginDetail creates a session for the user like Login and records info
+// with it, the client of the request served by the handlers if info is nil.
+// If refresh is true it works like LoginWithRefresh, otherwise the returned
+// refresh token is empty.
+func (m *MgoManager) LoginDetail(id string, stay time.Duration, refresh bool,
+	info *LoginInfo) (string, string, error) {
+	oid, err := getId(id)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = m.checkTokenKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	policies, err := m.userPolicies(oid)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = m.limitSession(oid, policies)
+	if err != nil {
+		return "", "", err
+	}
+
+	if info == nil && m.request != nil {
+		// the managers of the handlers log in the client of their request
+		info = NewLoginInfo(m.request, "")
+	}
+
+	state, token := m.newLoginState(oid, stay, info)
+	if info != nil {
+		m.bindFingerprint(state, info, policies)
+	}
+	var refreshToken string
+	if refresh {
+		refreshToken = newToken()
+		state.RefreshToken = m.hashToken(refreshToken)
+		state.TokenExpiredOn = state.CreatedOn.Add(m.AccessTokenTTL)
+		if state.TokenExpiredOn.After(state.ExpiredOn) {
+			state.TokenExpiredOn = state.ExpiredOn
+		}
+	}
+
+	err = m.LoginColl.Insert(state)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, refreshToken, nil
+}
+
+// revokeReusedSession ends the session a reused refresh token belongs to.
+func (m *MgoManager) revokeReusedSession(state *LoginState) {
+	m.LoginColl.RemoveAll(bson.M{"SessionId": state.SessionId})
+	m.invalidateUser(state.UserId)
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh
+// token. The old pair stops working. Presenting a refresh token which has
+// already been exchanged revokes the whole session and returns
+// ErrRefreshTokenReused as it means the token was stolen.
+func (m *MgoManager) Refresh(refresh string) (string, string, error) {
+	if !validToken(refresh) {
+		return "", "", authmodel.ErrInvalidToken
+	}
+
+	err := m.checkTokenKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	hashed := m.hashToken(refresh)
+	state := &LoginState{}
+	err = m.LoginColl.Find(bson.M{"RefreshToken": hashed}).One(state)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			return "", "", err
+		}
+
+		err = m.LoginColl.Find(bson.M{"UsedRefreshTokens": hashed}).One(state)
+		if err != nil {
+			if err == mgo.ErrNotFound {
+				return "", "", authmodel.ErrNotLogged
+			}
+			return "", "", err
+		}
+
+		m.revokeReusedSession(state)
+		return "", "", ErrRefreshTokenReused
+	}
+
+	now := time.Now()
+	if !state.ExpiredOn.After(now) {
+		m.LoginColl.RemoveId(state.Token)
+		return "", "", ErrSessionExpired
+	}
+
+	// only one of the concurrent refreshes with the same token can remove
+	// the old state, the others are treated as reuse.
+	err = m.LoginColl.Remove(bson.M{"_id": state.Token, "RefreshToken": hashed})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			m.revokeReusedSession(state)
+			return "", "", ErrRefreshTokenReused
+		}
+		return "", "", err
+	}
+
+	m.invalidateToken(state.Token)
+	token := newToken()
+	refresh = newToken()
+	state.Token = m.hashToken(token)
+	state.RefreshToken = m.hashToken(refresh)
+	state.UsedRefreshTokens = append(state.UsedRefreshTokens, hashed)
+	if n := len(state.UsedRefreshTokens); n > maxUsedRefreshTokens {
+		state.UsedRefreshTokens = state.UsedRefreshTokens[n-maxUsedRefreshTokens:]
+	}
+	state.RotateRequired = false
+	state.ExpiredOn = state.deadline(now)
+	state.LastSeen = now
+	state.TokenExpiredOn = now.Add(m.AccessTokenTTL)
+	if state.TokenExpiredOn.After(state.ExpiredOn) {
+		state.TokenExpiredOn = state.ExpiredOn
+	}
+
+	err = m.LoginColl.Insert(state)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, refresh, nil
+}
+
+// RotateToken replaces the token of a session with a new one, keeping the
+// session and its metadata, and returns it. The old token stops working. It
+// must be called when GetUser returns ErrRotateRequired.
+func (m *MgoManager) RotateToken(token string) (string, error) {
+	if !validToken(token) {
+		return "", authmodel.ErrInvalidToken
+	}
+
+	state, err := m.findLoginState(token)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return "", authmodel.ErrNotLogged
+		}
+		return "", err
+	}
+
+	if !state.ExpiredOn.After(time.Now()) {
+		m.LoginColl.RemoveId(state.Token)
+		return "", ErrSessionExpired
+	}
+
+	// a concurrent rotation may have removed it already
+	err = m.LoginColl.RemoveId(state.Token)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return "", authmodel.ErrNotLogged
+		}
+		return "", err
+	}
+
+	m.invalidateToken(state.Token)
+	token = newToken()
+	state.Token = m.hashToken(token)
+	state.Hashed = true
+	state.RotateRequired = false
+	if state.SessionId == "" {
+		state.SessionId = bson.NewObjectId()
+	}
+
+	err = m.LoginColl.Insert(state)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// revokeOtherSessions ends the sessions and JWTs of the user except the
+// session keep, when it is one of the user sessions.
+func (m *MgoManager) revokeOtherSessions(oid bson.ObjectId, keep *LoginState) error {
+	err := m.revokeUserJWT(oid)
+	if err != nil {
+		return err
+	}
+
+	query := bson.M{"UserId": oid}
+	if keep != nil && keep.UserId == oid && keep.SessionId != "" {
+		query["SessionId"] = bson.M{"$ne": keep.SessionId}
+	}
+
+	_, err = m.LoginColl.RemoveAll(query)
+	m.invalidateUser(oid)
+	return err
+}
+
+// tokensValidAfter returns the time before which the sessions of every user
+// are rejected, set by RevokeAllUsersSessions.
+func (m *MgoManager) tokensValidAfter() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, m.setting(ConfigTokensValidAfter))
+	return t
+}
+
+// RevokeAllSessions ends all the sessions and JWTs of the user, without
+// needing one of its tokens.
+func (m *MgoManager) RevokeAllSessions(userId string) error {
+	oid, err := getId(userId)
+	if err != nil {
+		return err
+	}
+
+	err = m.UserColl.UpdateId(oid, bson.M{
+		"$set": bson.M{"TokensValidAfter": time.Now()},
+	})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return authmodel.ErrNotFound
+		}
+		return err
+	}
+
+	err = m.revokeUserJWT(oid)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.LoginColl.RemoveAll(bson.M{"UserId": oid})
+	m.invalidateUser(oid)
+	return err
+}
+
+// RevokeAllUsersSessions logs every user out, for incident response. The
+// other app servers apply it once they reload their settings, within a
+// minute.
+func (m *MgoManager) RevokeAllUsersSessions() error {
+	err := m.Config.Set(ConfigTokensValidAfter,
+		time.Now().Format(time.RFC3339Nano))
+	m.invalidateAll()
+	return err
+}
+
+// RecentAuth reports whether the user authenticated with at least level
+// within maxAge before now.
+func (s *LoginState) RecentAuth(maxAge time.Duration, level int, now time.Time) bool {
+	return s.AuthLevel >= level && !s.AuthOn.IsZero() && now.Sub(s.AuthOn) <= maxAge
+}
+
+// Reauthenticate records that the user of the session token has just
+// proved its identity again with method, after the application checked the
+// password or second factor. Impersonation sessions cannot be upgraded.
+func (m *MgoManager) Reauthenticate(token, method string) error {
+	if !validToken(token) {
+		return authmodel.ErrInvalidToken
+	}
+
+	state, err := m.findLoginState(token)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return authmodel.ErrNotLogged
+		}
+		return err
+	}
+
+	if state.ImpersonatorId != "" {
+		return ErrImpersonated
+	}
+
+	err = m.LoginColl.UpdateId(state.Token, bson.M{"$set": bson.M{
+		"AuthMethod": method,
+		"AuthLevel":  authLevel(method),
+		"AuthOn":     time.Now(),
+	}})
+	m.invalidateToken(state.Token)
+	return err
+}
+
+// FindAllSession returns the live sessions of the user, newest first. The
+// tokens are not returned, sessions are identified by SessionId.
+func (m *MgoManager) FindAllSession(userId string) ([]*LoginState, error) {
+	oid, err := getId(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	states := []*LoginState{}
+	err = m.LoginColl.Find(bson.M{
+		"UserId":    oid,
+		"ExpiredOn": bson.M{"$gt": time.Now()},
+	}).Select(bson.M{
+		"_id":               0,
+		"RefreshToken":      0,
+		"UsedRefreshTokens": 0,
+	}).Sort("-CreatedOn").All(&states)
+	if err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
+
+// RevokeSession ends the session sessionId of the user without knowing its
+// token.
+func (m *MgoManager) RevokeSession(userId, sessionId string) error {
+	oid, err := getId(userId)
+	if err != nil {
+		return err
+	}
+
+	sid, err := getId(sessionId)
+	if err != nil {
+		return err
+	}
+
+	info, err := m.LoginColl.RemoveAll(bson.M{"UserId": oid, "SessionId": sid})
+	m.invalidateUser(oid)
+	if err != nil {
+		return err
+	}
+
+	if info.Removed == 0 {
+		return authmodel.ErrNotFound
+	}
+
+	return nil
+}
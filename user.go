@@ -1,24 +1,74 @@
 package mgoauth
 
 import (
-	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"github.com/gorilla/securecookie"
 	"github.com/kidstuff/auth/authmodel"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"net/http"
+	"os"
 	"strings"
 	"time"
 )
 
 var (
-	ErrNoResult = errors.New("mgoauth: no result")
+	ErrNoResult           = errors.New("mgoauth: no result")
+	ErrRefreshTokenReused = errors.New("mgoauth: refresh token reused")
+	// ErrSessionExpired is returned instead of authmodel.ErrNotLogged when
+	// the token belongs to a session which has expired.
+	ErrSessionExpired = errors.New("mgoauth: session expired")
+	// ErrImpersonated is returned when an impersonation session attempts a
+	// change the impersonator is not allowed to make, such as a password
+	// change.
+	ErrImpersonated = errors.New("mgoauth: not allowed while impersonating")
+	// ErrStepUpRequired is returned by the handlers wrapped with
+	// RequireRecentAuth when the user must authenticate again.
+	ErrStepUpRequired = errors.New("mgoauth: recent authentication required")
+	// ErrFingerprintMismatch is returned when a session bound with
+	// FingerprintStrict is used by another client.
+	ErrFingerprintMismatch = errors.New("mgoauth: session used by another client")
+	// ErrSessionRevoked is returned for the sessions created before
+	// RevokeAllSessions or RevokeAllUsersSessions was called.
+	ErrSessionRevoked = errors.New("mgoauth: session revoked")
+	// ErrPasswordExpired is returned when the password of the user is older
+	// than ConfigPwdMaxAge, it must be changed before going on.
+	ErrPasswordExpired = errors.New("mgoauth: password expired, must change")
+	// ErrRotateRequired is returned with ConfigRotateRequired for the tokens
+	// of a session marked with LoginState.RotateRequired, they must be
+	// replaced with RotateToken or Refresh.
+	ErrRotateRequired = errors.New("mgoauth: token must be rotated")
+	// ErrNoTokenKey is returned by the session operations while TokenKey is
+	// empty, usually because MGOAUTH_TOKEN_KEY is not set.
+	ErrNoTokenKey = errors.New("mgoauth: the login token key is not set")
 )
 
+// SessionLimitError is returned when a user already has the maximum number
+// of sessions and the session limit mode is SessionLimitRefuse.
+type SessionLimitError struct {
+	Limit int
+}
+
+func (e *SessionLimitError) Error() string {
+	return fmt.Sprintf("mgoauth: limit of %d sessions reached", e.Limit)
+}
+
 type User struct {
 	Id             bson.ObjectId `bson:"_id"`
 	authmodel.User `bson:",inline"`
+	// TokensValidAfter rejects the sessions and JWTs of the user created
+	// before it, see RevokeAllSessions.
+	TokensValidAfter time.Time `bson:"TokensValidAfter,omitempty"`
+	// LegacyPwd marks a password imported by ImportUser which was not
+	// hashed again yet.
+	LegacyPwd bool `bson:"LegacyPwd,omitempty"`
+	// PwdHistory holds the previous passwords of the user, oldest first,
+	// see ConfigPwdHistory.
+	PwdHistory []authmodel.Password `bson:"PwdHistory,omitempty"`
 }
 
 type MgoManager struct {
@@ -26,8 +76,55 @@ type MgoManager struct {
 	GroupColl              *mgo.Collection
 	UserColl               *mgo.Collection
 	LoginColl              *mgo.Collection
+	RevokedColl            *mgo.Collection
+	AuditColl              *mgo.Collection
+	Config                 *MgoConfigMngr
 	Formater               authmodel.FormatChecker
 	DefaultLimit           int
+	// TokenKey is the HMAC key used to hash login tokens before they are
+	// stored in LoginColl. NewMgoManager reads it from the MGOAUTH_TOKEN_KEY
+	// environment variable, it must be the same on every app server. The
+	// sessions cannot be created nor checked while it is empty.
+	TokenKey []byte
+	// Peppers are the secrets, by id, mixed into the passwords before they
+	// are hashed so a dump of UserColl is not enough to crack them. The
+	// passwords are hashed with PepperId, none if it is empty, and the ones
+	// hashed with another pepper are hashed again at login. NewMgoManager
+	// reads them with ParsePeppers from the MGOAUTH_PEPPER environment
+	// variable or the file named by MGOAUTH_PEPPER_FILE.
+	Peppers  map[string][]byte
+	PepperId string
+	// Cache, if set, keeps the users resolved by GetUser. Bus, if set,
+	// forwards its invalidations to the other app servers.
+	Cache *SessionCache
+	Bus   *InvalidationBus
+	// IdleTimeout ends sessions which are not used for that long. Zero
+	// disables it so sessions last for the whole stay given to Login.
+	IdleTimeout time.Duration
+	// AccessTokenTTL is the lifetime of the tokens issued together with a
+	// refresh token.
+	AccessTokenTTL time.Duration
+	// JWTMaxAge is the maximum lifetime of the tokens issued by IssueJWT.
+	JWTMaxAge time.Duration
+	// MaxImpersonationTTL is the maximum lifetime of the sessions created
+	// by Impersonate.
+	MaxImpersonationTTL time.Duration
+	// ActivityGranularity skips the LastActivity update of users which
+	// have been active more recently than that. Zero updates it on every
+	// GetUser.
+	ActivityGranularity time.Duration
+	// Activity, if set, receives the LastActivity updates instead of
+	// writing them directly.
+	Activity *ActivityWriter
+
+	// request is the request served by the managers created by the
+	// handlers, GetUserDetail checks the session fingerprint against it.
+	request *http.Request
+	// session is the session of request, see requestUser.
+	session *requestSession
+	// pepperErr is the error of reading the peppers, the passwords cannot
+	// be hashed nor checked until it is fixed.
+	pepperErr error
 }
 
 func NewMgoManager(db *mgo.Database) *MgoManager {
@@ -35,30 +132,23 @@ func NewMgoManager(db *mgo.Database) *MgoManager {
 		GroupColl:              db.C("mgoauth_group"),
 		UserColl:               db.C("mgoauth_user"),
 		LoginColl:              db.C("mgoauth_login"),
+		RevokedColl:            db.C("mgoauth_revoked"),
+		AuditColl:              db.C("mgoauth_audit"),
+		Config:                 NewMgoConfigMngr(db),
 		MinimumOnlineThreshold: time.Minute * 5,
 		DefaultLimit:           500,
+		AccessTokenTTL:         time.Minute * 15,
+		JWTMaxAge:              time.Hour * 24,
+		MaxImpersonationTTL:    time.Hour,
+		TokenKey:               []byte(os.Getenv("MGOAUTH_TOKEN_KEY")),
 	}
 
 	mngr.Formater, _ = authmodel.NewSimpleChecker(9)
+	mngr.Peppers, mngr.PepperId, mngr.pepperErr = loadEnvPeppers()
 
 	return mngr
 }
 
-func hashPwd(pwd string) (authmodel.Password, error) {
-	p := authmodel.Password{}
-	p.InitAt = time.Now()
-	p.Salt = securecookie.GenerateRandomKey(32)
-
-	pwdBytes := []byte(pwd)
-	tmp := make([]byte, len(pwdBytes)+len(p.Salt))
-	copy(tmp, pwdBytes)
-	tmp = append(tmp, p.Salt...)
-	b, err := bcrypt.GenerateFromPassword(tmp, bcrypt.DefaultCost)
-	p.Hashed = b
-
-	return p, err
-}
-
 func (m *MgoManager) newUser(email, pwd string, app bool) (*User, error) {
 	if !m.Formater.EmailValidate(email) {
 		return nil, authmodel.ErrInvalidEmail
@@ -68,18 +158,23 @@ func (m *MgoManager) newUser(email, pwd string, app bool) (*User, error) {
 		return nil, authmodel.ErrInvalidPassword
 	}
 
+	p, err := m.hashPwd(pwd)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUserPwd(email, &p, app), nil
+}
+
+// newUserPwd returns a user with the already hashed password p, its email
+// must be validated by the caller.
+func newUserPwd(email string, p *authmodel.Password, app bool) *User {
 	u := &User{}
 	u.Id = bson.NewObjectId()
 	sid := u.Id.Hex()
 	u.User.Id = &sid
 	u.Email = &email
-
-	p, err := hashPwd(pwd)
-	if err != nil {
-		return nil, err
-	}
-
-	u.Pwd = &p
+	u.Pwd = p
 
 	u.Approved = &app
 	if !app {
@@ -89,7 +184,7 @@ func (m *MgoManager) newUser(email, pwd string, app bool) (*User, error) {
 		}
 	}
 
-	return u, nil
+	return u
 }
 
 func (m *MgoManager) insertUser(u *User) error {
@@ -132,6 +227,13 @@ func (m *MgoManager) AddUserDetail(email, pwd string, app bool, pri []string,
 	if err != nil {
 		return nil, err
 	}
+
+	return m.insertUserDetail(u, pri, code, profile, groupIds)
+}
+
+// insertUserDetail sets the details of AddUserDetail to u and inserts it.
+func (m *MgoManager) insertUserDetail(u *User, pri []string, code map[string]string,
+	profile *authmodel.Profile, groupIds []string) (*authmodel.User, error) {
 	u.Privileges = pri
 	u.ConfirmCodes = code
 	u.Profile = profile
@@ -142,7 +244,7 @@ func (m *MgoManager) AddUserDetail(email, pwd string, app bool, pri []string,
 		}
 	}
 
-	err = m.insertUser(u)
+	err := m.insertUser(u)
 	if err != nil {
 		return nil, err
 	}
@@ -150,14 +252,32 @@ func (m *MgoManager) AddUserDetail(email, pwd string, app bool, pri []string,
 	return &u.User, nil
 }
 
+// UpdateUserDetail updates the user id on behalf of the session of the
+// request served by the handlers, see UpdateUserDetailAs.
 func (m *MgoManager) UpdateUserDetail(id string, pwd *string, app *bool, pri []string,
 	code map[string]string, profile *authmodel.Profile, groupIds []string) error {
+	_, actor, err := m.requestUser(m.request)
+	if err != nil {
+		return err
+	}
+
+	return m.UpdateUserDetailAs(actor, id, pwd, app, pri, code, profile, groupIds)
+}
+
+// UpdateUserDetailAs works like UpdateUserDetail on behalf of the session
+// actor, as returned by GetUserDetail, nil for a change which is not made by
+// a logged user. An impersonation session cannot change passwords, and
+// the actor session is kept when ConfigPwdChangeRevoke ends the others.
+func (m *MgoManager) UpdateUserDetailAs(actor *LoginState, id string, pwd *string,
+	app *bool, pri []string, code map[string]string, profile *authmodel.Profile,
+	groupIds []string) error {
 	if !bson.IsObjectIdHex(id) {
 		return authmodel.ErrInvalidId
 	}
 	oid := bson.ObjectIdHex(id)
 
 	changes := make(bson.M)
+	update := bson.M{"$set": changes}
 	if pri != nil {
 		changes["Privileges"] = pri
 	}
@@ -181,23 +301,115 @@ func (m *MgoManager) UpdateUserDetail(id string, pwd *string, app *bool, pri []s
 		changes["Profile"] = profile
 	}
 	if pwd != nil {
-		var err error
-		changes["Pwd"], err = hashPwd(*pwd)
+		if actor != nil && actor.ImpersonatorId != "" {
+			return ErrImpersonated
+		}
+
+		update["$unset"] = bson.M{"LegacyPwd": ""}
+		err := m.checkPwdHistory(oid, *pwd, update)
+		if err != nil {
+			return err
+		}
+
+		changes["Pwd"], err = m.hashPwd(*pwd)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.UserColl.UpdateId(oid, update)
+	if err != nil {
+		return err
+	}
+	// only once every write is done, or a concurrent GetUser could cache
+	// the old state again
+	defer m.invalidateUser(oid)
+
+	if pwd != nil && m.settingBool(ConfigPwdChangeRevoke) {
+		err = m.revokeOtherSessions(oid, actor)
+		if err != nil {
+			return err
+		}
+	}
+
+	if pri != nil || groupIds != nil {
+		// the JWTs carry no session to mark, they are revoked
+		err = m.revokeUserJWT(oid)
 		if err != nil {
 			return err
 		}
 	}
 
-	return m.UserColl.UpdateId(oid, bson.M{"$set": changes})
+	if pri != nil || groupIds != nil || pwd != nil {
+		// the tokens issued before the change must be replaced
+		_, err = m.LoginColl.UpdateAll(bson.M{"UserId": oid},
+			bson.M{"$set": bson.M{"RotateRequired": true}})
+	}
+
+	return err
 }
 
 func (m *MgoManager) DeleteUser(id string) error {
+	_, err := m.DeleteUserDetail(id)
+	return err
+}
+
+// DeleteResult describes the data removed along with a user. The audit
+// entries about the user are kept on purpose, they are the trail of what
+// was done to the account.
+type DeleteResult struct {
+	// Sessions is the number of sessions of the user, and of the
+	// impersonation sessions opened by the user, removed.
+	Sessions int
+}
+
+// DeleteUserDetail deletes the user with its sessions but not its audit
+// entries. The JWTs already issued to the user are revoked until they
+// expire. The removal goes on when the user document is already gone, to
+// clean up what a previous failed call left.
+func (m *MgoManager) DeleteUserDetail(id string) (*DeleteResult, error) {
 	oid, err := getId(id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	found := true
+	err = m.UserColl.RemoveId(oid)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			return nil, err
+		}
+		found = false
+	}
+	// the cache is only cleared once the sessions are gone
+	defer m.invalidateUser(oid)
+
+	result := &DeleteResult{}
+	info, err := m.LoginColl.RemoveAll(bson.M{"UserId": oid})
+	if err != nil {
+		return nil, err
 	}
+	result.Sessions = info.Removed
 
-	return m.UserColl.RemoveId(oid)
+	info, err = m.LoginColl.RemoveAll(bson.M{"ImpersonatorId": oid})
+	if err != nil {
+		return nil, err
+	}
+	if info.Removed > 0 {
+		result.Sessions += info.Removed
+		m.invalidateAll()
+	}
+
+	err = m.revokeUserJWT(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return result, authmodel.ErrNotFound
+	}
+
+	return result, nil
 }
 
 func (m *MgoManager) FindUser(id string) (*authmodel.User, error) {
@@ -293,24 +505,55 @@ func (m *MgoManager) FindAllUser(limit int, offsetId string, fields []string,
 	return m.findAll(limit, offsetId, fields, filter)
 }
 
+// onlineFilter matches the users active within MinimumOnlineThreshold, or
+// the members of groupIds only if it is not nil. The threshold is widened by
+// ActivityGranularity since LastActivity may lag behind by that much.
+func (m *MgoManager) onlineFilter(groupIds []string) bson.M {
+	filter := bson.M{
+		"LastActivity": bson.M{
+			"$gt": time.Now().Add(-m.MinimumOnlineThreshold - m.ActivityGranularity),
+		},
+	}
+	if groupIds != nil {
+		filter["Groups.Id"] = bson.M{"$in": groupIds}
+	}
+
+	return filter
+}
+
 func (m *MgoManager) FindAllUserOnline(limit int, offsetId string, fields []string) (
 	[]*authmodel.User, error) {
-	return m.findAll(limit, offsetId, fields, bson.M{
-		"LastActivity": bson.M{"$lt": time.Now().Add(m.MinimumOnlineThreshold)},
-	})
+	return m.FindAllUserOnlineDetail(limit, offsetId, fields, nil)
 }
 
-func (m *MgoManager) updateLastActivity(id bson.ObjectId) (*authmodel.User, error) {
-	user := &authmodel.User{}
-	err := m.UserColl.FindId(id).One(user)
-	if err != nil {
-		return nil, err
-	}
+// FindAllUserOnlineDetail works like FindAllUserOnline but if groupIds is not
+// nil only the members of those groups are returned.
+func (m *MgoManager) FindAllUserOnlineDetail(limit int, offsetId string,
+	fields []string, groupIds []string) ([]*authmodel.User, error) {
+	return m.findAll(limit, offsetId, fields, m.onlineFilter(groupIds))
+}
+
+// CountUserOnline returns the number of online users, or of the online
+// members of groupIds if it is not nil.
+func (m *MgoManager) CountUserOnline(groupIds []string) (int, error) {
+	return m.UserColl.Find(m.onlineFilter(groupIds)).Count()
+}
 
+func (m *MgoManager) updateLastActivity(u *User) (*authmodel.User, error) {
+	user := &u.User
 	now := time.Now()
+	if user.LastActivity != nil && now.Sub(*user.LastActivity) < m.ActivityGranularity {
+		return user, nil
+	}
+
 	user.LastActivity = &now
+	if m.Activity != nil {
+		m.Activity.Touch(u.Id, now)
+		return user, nil
+	}
+
 	// ??? should we ignore the error return here?
-	err = m.UserColl.UpdateId(id, bson.M{
+	err := m.UserColl.UpdateId(u.Id, bson.M{
 		"$set": bson.M{"LastActivity": *user.LastActivity},
 	})
 	if err != nil {
@@ -320,70 +563,214 @@ func (m *MgoManager) updateLastActivity(id bson.ObjectId) (*authmodel.User, erro
 	return user, nil
 }
 
+// hashToken returns the keyed hash of token which is stored in LoginColl
+// instead of the token itself.
+func (m *MgoManager) hashToken(token string) string {
+	mac := hmac.New(sha256.New, m.TokenKey)
+	mac.Write([]byte(token))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkTokenKey returns ErrNoTokenKey if the tokens cannot be hashed.
+func (m *MgoManager) checkTokenKey() error {
+	if len(m.TokenKey) == 0 {
+		return ErrNoTokenKey
+	}
+
+	return nil
+}
+
+// legacyToken matches the login states written before tokens were hashed,
+// their _id is the raw token. They are still accepted until they expire.
+func legacyToken(token string) bson.M {
+	return bson.M{"_id": token, "Hashed": bson.M{"$exists": false}}
+}
+
+func (m *MgoManager) findLoginState(token string) (*LoginState, error) {
+	err := m.checkTokenKey()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &LoginState{}
+	err = m.LoginColl.FindId(m.hashToken(token)).One(state)
+	if err == mgo.ErrNotFound && !strings.HasPrefix(token, tokenPrefix) {
+		err = m.LoginColl.Find(legacyToken(token)).One(state)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// GetUser returns the user logged in with token, which is either a login
+// token or a JWT issued by IssueJWT.
 func (m *MgoManager) GetUser(token string) (*authmodel.User, error) {
-	state := LoginState{}
-	err := m.LoginColl.FindId(token).One(&state)
+	user, _, err := m.GetUserDetail(token)
+	return user, err
+}
+
+// GetUserDetail works like GetUser and also returns the session of the
+// token, so handlers can tell an impersonation (LoginState.ImpersonatorId)
+// apart. The session is nil for JWTs.
+func (m *MgoManager) GetUserDetail(token string) (*authmodel.User, *LoginState,
+	error) {
+	if m.request != nil && token != "" && token == requestToken(m.request) {
+		return m.requestUser(m.request)
+	}
+
+	return m.GetUserRequest(token, m.request)
+}
+
+// GetUserRequest works like GetUserDetail and also checks that req comes
+// from the client the session is bound to, see ConfigFingerprintMode.
+func (m *MgoManager) GetUserRequest(token string, req *http.Request) (
+	*authmodel.User, *LoginState, error) {
+	if isJWT(token) {
+		user, err := m.getJWTUser(token)
+		return user, nil, err
+	}
+
+	user, state, err := m.getUser(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if state.RotateRequired && m.settingBool(ConfigRotateRequired) {
+		return nil, nil, ErrRotateRequired
+	}
+
+	if req != nil {
+		err = m.checkFingerprint(state, req)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	state.PwdExpired = !state.PwdExpiredOn.IsZero() && !state.PwdExpiredOn.After(time.Now())
+	return user, state, nil
+}
+
+func (m *MgoManager) getUser(token string) (*authmodel.User, *LoginState,
+	error) {
+	if !validToken(token) {
+		return nil, nil, authmodel.ErrInvalidToken
+	}
+
+	key := m.hashToken(token)
+	now := time.Now()
+	if user, state, ok := m.Cache.get(key, now); ok {
+		return user, state, nil
+	}
+
+	state, err := m.findLoginState(token)
 	if err != nil {
 		if err == mgo.ErrNotFound {
-			return nil, authmodel.ErrNotLogged
+			return nil, nil, authmodel.ErrNotLogged
 		}
-		return nil, err
+		return nil, nil, err
 	}
 
-	if !state.ExpiredOn.After(time.Now()) {
-		m.LoginColl.RemoveId(token)
+	if !state.ExpiredOn.After(now) {
+		// don't wait for the TTL index to sweep it
+		m.LoginColl.RemoveId(state.Token)
+		return nil, nil, ErrSessionExpired
 	}
 
-	return m.updateLastActivity(state.UserId)
-}
+	if !state.TokenExpiredOn.IsZero() && !state.TokenExpiredOn.After(now) {
+		// the session may still be refreshed
+		return nil, nil, ErrSessionExpired
+	}
 
-func (m *MgoManager) Login(id string, stay time.Duration) (string, error) {
-	if stay < m.MinimumOnlineThreshold {
-		stay = m.MinimumOnlineThreshold
+	u := &User{}
+	err = m.UserColl.FindId(state.UserId).One(u)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			// the user was deleted without its sessions
+			m.LoginColl.RemoveId(state.Token)
+			return nil, nil, authmodel.ErrNotFound
+		}
+		return nil, nil, err
 	}
 
-	oid, err := getId(id)
+	if state.CreatedOn.Before(u.TokensValidAfter) ||
+		state.CreatedOn.Before(m.tokensValidAfter()) {
+		m.LoginColl.RemoveId(state.Token)
+		return nil, nil, ErrSessionRevoked
+	}
+
+	policies, err := m.groupPolicies(u.Groups)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
+	state.PwdExpiredOn = m.pwdExpiry(u.Pwd, policies).ExpiredOn
 
-	state := LoginState{
-		ExpiredOn: time.Now().Add(stay),
-		UserId:    oid,
-		Token: oid.Hex() + base64.URLEncoding.
-			EncodeToString(securecookie.GenerateRandomKey(64)),
+	if exp := state.deadline(now); exp.Sub(state.ExpiredOn) > state.IdleTimeout/10 ||
+		now.Sub(state.LastSeen) > lastSeenGranularity {
+		err = m.LoginColl.UpdateId(state.Token, bson.M{
+			"$set": bson.M{"ExpiredOn": exp, "LastSeen": now},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		state.ExpiredOn = exp
+		state.LastSeen = now
 	}
 
-	err = m.LoginColl.Insert(&state)
+	user, err := m.updateLastActivity(u)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 
-	return state.Token, nil
+	m.Cache.add(key, state, user)
+	return user, state, nil
+}
+
+// Login creates a session for the user and returns its token. The managers
+// created by the handlers record the client of their request with it, see
+// NewLoginInfo. If the password of the user expired, GetUserDetail tells it
+// with LoginState.PwdExpired and RequireFreshPwd refuses the token.
+func (m *MgoManager) Login(id string, stay time.Duration) (string, error) {
+	token, _, err := m.LoginDetail(id, stay, false, nil)
+	return token, err
 }
 
 func (m *MgoManager) Logout(token string, all bool) error {
+	if isJWT(token) {
+		return m.revokeJWT(token, all)
+	}
+
+	if !validToken(token) {
+		return authmodel.ErrInvalidToken
+	}
+
+	err := m.checkTokenKey()
+	if err != nil {
+		return err
+	}
+
 	if all {
-		state := LoginState{}
-		err := m.LoginColl.FindId(token).One(&state)
+		state, err := m.findLoginState(token)
 		if err != nil {
 			return authmodel.ErrInvalidToken
 		}
 
+		err = m.revokeUserJWT(state.UserId)
+		if err != nil {
+			return err
+		}
+
 		_, err = m.LoginColl.RemoveAll(bson.M{"UserId": state.UserId})
+		m.invalidateUser(state.UserId)
 		return err
 	}
-	return m.LoginColl.RemoveId(token)
-}
 
-func (m *MgoManager) ComparePassword(ps string, pwd *authmodel.Password) error {
-	pwdBytes := []byte(ps)
-	tmp := make([]byte, len(pwdBytes)+len(pwd.Salt))
-	copy(tmp, pwdBytes)
-	tmp = append(tmp, pwd.Salt...)
-	if err := bcrypt.CompareHashAndPassword(pwd.Hashed, tmp); err != nil {
-		return err
+	key := m.hashToken(token)
+	err = m.LoginColl.RemoveId(key)
+	if err == mgo.ErrNotFound && !strings.HasPrefix(token, tokenPrefix) {
+		err = m.LoginColl.Remove(legacyToken(token))
 	}
-
-	return nil
+	m.invalidateToken(key)
+	return err
 }
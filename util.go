@@ -1,16 +1,101 @@
 package mgoauth
 
 import (
+	"encoding/base64"
+	"github.com/gorilla/securecookie"
 	"github.com/kidstuff/auth/authmodel"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"strings"
 	"time"
 )
 
 type LoginState struct {
-	ExpiredOn time.Time     `bson:"ExpiredOn"`
-	UserId    bson.ObjectId `bson:"UserId"`
-	Token     string        `bson:"_id"`
+	// ExpiredOn is the idle deadline of the session, it slides forward on
+	// every GetUser but never passes AbsoluteExpiredOn.
+	ExpiredOn         time.Time     `bson:"ExpiredOn"`
+	AbsoluteExpiredOn time.Time     `bson:"AbsoluteExpiredOn,omitempty"`
+	IdleTimeout       time.Duration `bson:"IdleTimeout,omitempty"`
+	UserId            bson.ObjectId `bson:"UserId"`
+	// SessionId identifies the session across token refreshes.
+	SessionId bson.ObjectId `bson:"SessionId,omitempty"`
+	// Token is the hashed login token, or the raw one for states stored
+	// before hashing was introduced (Hashed is false).
+	Token  string `bson:"_id"`
+	Hashed bool   `bson:"Hashed,omitempty"`
+	// TokenExpiredOn limits the access token of sessions created with a
+	// refresh token, RefreshToken is hashed like Token.
+	TokenExpiredOn    time.Time `bson:"TokenExpiredOn,omitempty"`
+	RefreshToken      string    `bson:"RefreshToken,omitempty"`
+	UsedRefreshTokens []string  `bson:"UsedRefreshTokens,omitempty"`
+	CreatedOn         time.Time `bson:"CreatedOn,omitempty"`
+	LastSeen          time.Time `bson:"LastSeen,omitempty"`
+	IP                string    `bson:"IP,omitempty"`
+	UserAgent         string    `bson:"UserAgent,omitempty"`
+	Device            string    `bson:"Device,omitempty"`
+	// ImpersonatorId is the admin who created the session with Impersonate.
+	ImpersonatorId bson.ObjectId `bson:"ImpersonatorId,omitempty"`
+	// AuthMethod and AuthLevel tell how the user last proved its identity
+	// in this session, at AuthOn.
+	AuthMethod string    `bson:"AuthMethod,omitempty"`
+	AuthLevel  int       `bson:"AuthLevel,omitempty"`
+	AuthOn     time.Time `bson:"AuthOn,omitempty"`
+	// FingerprintMode tells what GetUserRequest does when the client does
+	// not match IPPrefix or UserAgentHash, the session is then marked as
+	// Suspicious.
+	FingerprintMode string `bson:"FingerprintMode,omitempty"`
+	IPPrefix        string `bson:"IPPrefix,omitempty"`
+	UserAgentHash   string `bson:"UserAgentHash,omitempty"`
+	Suspicious      bool   `bson:"Suspicious,omitempty"`
+	// RotateRequired is set when the privileges, groups or password of the
+	// user changed, with ConfigRotateRequired GetUser refuses the token until
+	// it is replaced with RotateToken.
+	RotateRequired bool `bson:"RotateRequired,omitempty"`
+	// PwdExpiredOn is when the password of the user expires, zero if it
+	// does not. It is computed by GetUser from the current settings.
+	PwdExpiredOn time.Time `bson:"-"`
+	// PwdExpired is set by GetUserDetail once PwdExpiredOn is past, the
+	// user must change its password. See RequireFreshPwd.
+	PwdExpired bool `bson:"-"`
+}
+
+const (
+	// tokenPrefix versions the login token format. A token is the prefix
+	// followed by 32 random bytes in unpadded URL safe base64.
+	tokenPrefix = "mgo1_"
+	tokenLen    = len(tokenPrefix) + 43
+	// legacyTokenLen is the length of the tokens issued before tokenPrefix,
+	// an ObjectIdHex followed by 64 random bytes in URL safe base64.
+	legacyTokenLen = 24 + 88
+)
+
+// newToken returns a new random login token.
+func newToken() string {
+	return tokenPrefix + strings.TrimRight(base64.URLEncoding.
+		EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
+
+// isBase64URL reports whether s only contains unpadded URL safe base64
+// characters.
+func isBase64URL(s string) bool {
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// validToken reports whether token is well formed so malformed tokens can be
+// rejected without a database round trip.
+func validToken(token string) bool {
+	if strings.HasPrefix(token, tokenPrefix) {
+		return len(token) == tokenLen && isBase64URL(token[len(tokenPrefix):])
+	}
+
+	return len(token) == legacyTokenLen && bson.IsObjectIdHex(token[:24]) &&
+		isBase64URL(strings.TrimRight(token[24:], "="))
 }
 
 // getId returns bson.ObjectId form given id.
@@ -28,6 +113,9 @@ func EnsureIndex(db *mgo.Database) error {
 	groupColl := db.C("mgoauth_group")
 	userColl := db.C("mgoauth_user")
 	loginColl := db.C("mgoauth_login")
+	busColl := db.C("mgoauth_invalidation")
+	revokedColl := db.C("mgoauth_revoked")
+	auditColl := db.C("mgoauth_audit")
 
 	err := userColl.EnsureIndex(mgo.Index{
 		Key:    []string{"Email"},
@@ -47,6 +135,20 @@ func EnsureIndex(db *mgo.Database) error {
 		return err
 	}
 
+	// ComparePassword finds the user of a password by its hash
+	err = userColl.EnsureIndexKey("Pwd.Hashed")
+	if err != nil {
+		return err
+	}
+
+	err = userColl.EnsureIndex(mgo.Index{
+		Key:    []string{"LegacyPwd"},
+		Sparse: true,
+	})
+	if err != nil {
+		return err
+	}
+
 	err = loginColl.EnsureIndex(mgo.Index{
 		Key: []string{"UserId"},
 	})
@@ -54,6 +156,25 @@ func EnsureIndex(db *mgo.Database) error {
 		return err
 	}
 
+	err = loginColl.EnsureIndex(mgo.Index{
+		Key:    []string{"RefreshToken"},
+		Unique: true,
+		Sparse: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = loginColl.EnsureIndexKey("UsedRefreshTokens")
+	if err != nil {
+		return err
+	}
+
+	err = loginColl.EnsureIndexKey("SessionId")
+	if err != nil {
+		return err
+	}
+
 	err = loginColl.EnsureIndex(mgo.Index{
 		Key:         []string{"ExpiredOn"},
 		ExpireAfter: time.Minute,
@@ -64,6 +185,42 @@ func EnsureIndex(db *mgo.Database) error {
 		Unique: true,
 	})
 
+	err = revokedColl.EnsureIndex(mgo.Index{
+		Key:         []string{"ExpiredOn"},
+		ExpireAfter: time.Second,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = auditColl.EnsureIndexKey("UserId")
+	if err != nil {
+		return err
+	}
+
+	err = auditColl.EnsureIndexKey("ActorId")
+	if err != nil {
+		return err
+	}
+
+	err = busColl.Create(&mgo.CollectionInfo{
+		Capped:   true,
+		MaxBytes: busCollSize,
+	})
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return err
+	}
+
+	// a tailable cursor on an empty capped collection dies at once, the bus
+	// would keep tailing again until the first event
+	n, err := busColl.Count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return busColl.Insert(&invalidation{Id: bson.NewObjectId()})
+	}
+
 	return nil
 }
 